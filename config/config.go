@@ -10,8 +10,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 // ErrEncryptionPasswordRequired is returned when credentials file exists but no encryption password is provided
@@ -21,8 +28,261 @@ const (
 	configDir  = ".go-socks5-chain"
 	configFile = "upstream_config"
 	credsFile  = "upstream_creds.enc"
+	usersFile  = "local_users"
+)
+
+// Upstream hop types
+const (
+	HopTypeSOCKS5 = "socks5"
+	HopTypeHTTP   = "http"
+	HopTypeSSH    = "ssh"
 )
 
+// Strategies for spreading connections across the upstream endpoints
+const (
+	// BalanceFailover uses the endpoints in configured order
+	BalanceFailover = "failover"
+	// BalanceRoundRobin takes turns between the endpoints by weight
+	BalanceRoundRobin = "round-robin"
+	// BalanceLeastConnections picks the endpoint with the fewest active
+	// connections relative to its weight
+	BalanceLeastConnections = "least-connections"
+	// BalanceLowestLatency picks the endpoint with the fastest health check
+	BalanceLowestLatency = "lowest-latency"
+	// BalanceHashClient and BalanceHashTarget keep a client IP or a target
+	// host on the same endpoint for as long as it is available
+	BalanceHashClient = "hash-client"
+	BalanceHashTarget = "hash-target"
+)
+
+// Where target host names are resolved
+const (
+	// ResolveRemote sends host names to the upstream to resolve
+	ResolveRemote = "remote"
+	// ResolveLocal resolves host names here and sends the upstream an address
+	ResolveLocal = "local"
+	// ResolvePreserve sends each target in the form the client used, so a
+	// SOCKS client's host name stays a name even if it is an IP literal
+	ResolvePreserve = "preserve"
+)
+
+// BalanceStrategies lists the valid values of Config.Balance
+var BalanceStrategies = []string{
+	BalanceFailover,
+	BalanceRoundRobin,
+	BalanceLeastConnections,
+	BalanceLowestLatency,
+	BalanceHashClient,
+	BalanceHashTarget,
+}
+
+// Hop is one upstream proxy in the chain
+type Hop struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// Type is HopTypeSOCKS5 (the default when empty), HopTypeHTTP or HopTypeSSH
+	Type string `json:"type,omitempty"`
+	// TLS wraps the connection to the hop in TLS, configured by TLSOptions
+	TLS        bool        `json:"tls,omitempty"`
+	TLSOptions *TLSOptions `json:"tls_options,omitempty"`
+
+	// PrivateKey is a PEM encoded key for SSH hops. If it is encrypted,
+	// Password is used as its passphrase.
+	PrivateKey string `json:"private_key,omitempty"`
+	// KnownHosts is the known_hosts file used to verify SSH hops, by
+	// default ~/.ssh/known_hosts
+	KnownHosts string `json:"known_hosts,omitempty"`
+}
+
+// TLSOptions configures TLS to a hop. Relative file names are looked up in
+// the config directory.
+type TLSOptions struct {
+	// ServerName overrides the name sent as SNI and checked in the certificate
+	ServerName string `json:"server_name,omitempty"`
+	// CAFile is a PEM bundle of CAs trusted instead of the system roots
+	CAFile string `json:"ca_file,omitempty"`
+	// Pins are base64 SHA-256 hashes of trusted SubjectPublicKeyInfos,
+	// optionally prefixed with "sha256/". Without CAFile they replace chain
+	// verification and must match the hop's own certificate.
+	Pins []string `json:"pins,omitempty"`
+	// CertFile and KeyFile hold a client certificate to present
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+}
+
+// Endpoint is one address of the primary upstream
+type Endpoint struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// Weight is the endpoint's share of connections for the balancing
+	// strategies that use one; 0 counts as 1
+	Weight int `json:"weight,omitempty"`
+}
+
+// Addr returns the endpoint's host:port address
+func (e Endpoint) Addr() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
+
+// ListenTLS configures TLS on the local listener. Relative file names are
+// looked up in the config directory.
+type ListenTLS struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ClientCAFile, if set, requires clients to present a certificate
+	// issued by one of the CAs in this PEM bundle
+	ClientCAFile string `json:"client_ca_file,omitempty"`
+}
+
+// Addr returns the hop's host:port address
+func (h Hop) Addr() string {
+	return net.JoinHostPort(h.Host, strconv.Itoa(h.Port))
+}
+
+// IsSOCKS5 reports whether the hop is a SOCKS5 proxy
+func (h Hop) IsSOCKS5() bool {
+	return h.Type == "" || h.Type == HopTypeSOCKS5
+}
+
+// IsHTTP reports whether the hop is an HTTP CONNECT proxy
+func (h Hop) IsHTTP() bool {
+	return h.Type == HopTypeHTTP
+}
+
+// IsSSH reports whether the hop is an SSH server
+func (h Hop) IsSSH() bool {
+	return h.Type == HopTypeSSH
+}
+
+// validate checks the settings that depend on the hop type
+func (h Hop) validate() error {
+	if !h.IsSOCKS5() && !h.IsHTTP() && !h.IsSSH() {
+		return fmt.Errorf("unknown upstream type %q", h.Type)
+	}
+	if h.IsSSH() && h.Username == "" {
+		return fmt.Errorf("SSH hop %s requires a username", h.Addr())
+	}
+	return nil
+}
+
+// ParseHopType parses a hop scheme: socks5, socks5s (SOCKS5 over TLS), http,
+// https (HTTP over TLS) or ssh
+func ParseHopType(scheme string) (hopType string, useTLS bool, err error) {
+	switch strings.ToLower(scheme) {
+	case "", HopTypeSOCKS5:
+		return "", false, nil
+	case HopTypeHTTP:
+		return HopTypeHTTP, false, nil
+	case "https":
+		return HopTypeHTTP, true, nil
+	case "socks5s":
+		return "", true, nil
+	case HopTypeSSH:
+		return HopTypeSSH, false, nil
+	default:
+		return "", false, fmt.Errorf("unknown upstream type %q", scheme)
+	}
+}
+
+// hostConfig is the unencrypted part of the configuration stored in configFile
+type hostConfig struct {
+	UpstreamHost string `json:"upstream_host"`
+	UpstreamPort int    `json:"upstream_port"`
+	UpstreamType string `json:"upstream_type,omitempty"`
+	UpstreamTLS  bool   `json:"upstream_tls,omitempty"`
+	KnownHosts   string `json:"known_hosts,omitempty"`
+	Chain        []Hop  `json:"chain,omitempty"`
+
+	UpstreamTLSOptions *TLSOptions `json:"upstream_tls_options,omitempty"`
+	ListenTLS          *ListenTLS  `json:"listen_tls,omitempty"`
+
+	Endpoints           []Endpoint `json:"endpoints,omitempty"`
+	UpstreamWeight      int        `json:"upstream_weight,omitempty"`
+	Balance             string     `json:"balance,omitempty"`
+	HealthCheckInterval int        `json:"health_check_interval,omitempty"`
+
+	Rules  []Rule           `json:"rules,omitempty"`
+	Chains map[string][]Hop `json:"chains,omitempty"`
+
+	PACListen string `json:"pac_listen,omitempty"`
+	Resolve   string `json:"resolve,omitempty"`
+
+	DNSListen   string `json:"dns_listen,omitempty"`
+	DNSResolver string `json:"dns_resolver,omitempty"`
+
+	Forwards []Forward `json:"forwards,omitempty"`
+	Reverse  []string  `json:"reverse,omitempty"`
+
+	TransparentListen string `json:"transparent_listen,omitempty"`
+	TProxyListen      string `json:"tproxy_listen,omitempty"`
+
+	ProxyProtocol []string   `json:"proxy_protocol,omitempty"`
+	Listeners     []Listener `json:"listeners,omitempty"`
+}
+
+// newHostConfig extracts the non-secret settings from cfg
+func newHostConfig(cfg *Config) hostConfig {
+	hc := hostConfig{
+		UpstreamHost: cfg.UpstreamHost,
+		UpstreamPort: cfg.UpstreamPort,
+		UpstreamType: cfg.UpstreamType,
+		UpstreamTLS:  cfg.UpstreamTLS,
+		KnownHosts:   cfg.KnownHosts,
+
+		UpstreamTLSOptions: cfg.UpstreamTLSOptions,
+		ListenTLS:          cfg.ListenTLS,
+
+		Endpoints:           cfg.Endpoints,
+		UpstreamWeight:      cfg.UpstreamWeight,
+		Balance:             cfg.Balance,
+		HealthCheckInterval: cfg.HealthCheckInterval,
+
+		Rules: cfg.Rules,
+		Chain: publicHops(cfg.Chain),
+
+		PACListen: cfg.PACListen,
+		Resolve:   cfg.Resolve,
+
+		DNSListen:   cfg.DNSListen,
+		DNSResolver: cfg.DNSResolver,
+
+		Forwards: cfg.Forwards,
+		Reverse:  cfg.Reverse,
+
+		TransparentListen: cfg.TransparentListen,
+		TProxyListen:      cfg.TProxyListen,
+
+		ProxyProtocol: cfg.ProxyProtocol,
+		Listeners:     cfg.Listeners,
+	}
+	for name, hops := range cfg.Chains {
+		if hc.Chains == nil {
+			hc.Chains = make(map[string][]Hop)
+		}
+		hc.Chains[name] = publicHops(hops)
+	}
+	return hc
+}
+
+// publicHops returns hops without their credentials
+func publicHops(hops []Hop) []Hop {
+	var public []Hop
+	for _, hop := range hops {
+		public = append(public, Hop{
+			Host:       hop.Host,
+			Port:       hop.Port,
+			Type:       hop.Type,
+			TLS:        hop.TLS,
+			TLSOptions: hop.TLSOptions,
+			KnownHosts: hop.KnownHosts,
+		})
+	}
+	return public
+}
+
 type Config struct {
 	Username     string
 	Password     string
@@ -31,6 +291,82 @@ type Config struct {
 	LocalHost    string
 	LocalPort    int
 	LogFile      string
+
+	// UpstreamType, UpstreamTLS and UpstreamTLSOptions select the protocol
+	// of the primary upstream, as for Hop
+	UpstreamType       string
+	UpstreamTLS        bool
+	UpstreamTLSOptions *TLSOptions
+
+	// PrivateKey and KnownHosts configure an SSH primary upstream, as for Hop
+	PrivateKey string
+	KnownHosts string
+
+	// ListenTLS, if set, makes the local listener serve TLS
+	ListenTLS *ListenTLS
+
+	// Endpoints are further addresses of the primary upstream, which share
+	// its credentials and settings. Connections fail over between them.
+	Endpoints []Endpoint
+	// UpstreamWeight is the Endpoint weight of UpstreamHost and UpstreamPort
+	UpstreamWeight int
+	// Balance is the strategy used to pick an endpoint for each connection,
+	// one of BalanceStrategies; empty means BalanceFailover
+	Balance string
+	// HealthCheckInterval is the number of seconds between health checks
+	// of the endpoints; 0 uses the default
+	HealthCheckInterval int
+
+	// Chain holds additional hops reached through the primary upstream, in
+	// order. The last hop receives the client's CONNECT request.
+	Chain []Hop
+
+	// Rules route connections by target and client, first match wins.
+	// Connections no rule matches go through the upstream chain.
+	Rules []Rule
+	// Chains are alternate upstream chains for RouteChain rules, by name.
+	// Their first hop is dialed directly.
+	Chains map[string][]Hop
+
+	// PACListen, if set, is the address a proxy auto-config file generated
+	// from Rules is served on, as /proxy.pac and /wpad.dat
+	PACListen string
+
+	// Resolve says where target host names are resolved: ResolveRemote,
+	// ResolveLocal or ResolvePreserve; empty means ResolveRemote
+	Resolve string
+
+	// DNSListen, if set, is the address a DNS server is run on, over UDP
+	// and TCP. Queries are forwarded over TCP to DNSResolver, a host:port
+	// reached through the upstream chain; empty means 1.1.1.1:53.
+	DNSListen   string
+	DNSResolver string
+
+	// Forwards are static port forwards through the chain
+	Forwards []Forward
+	// Reverse lists host:port services on this side that are exposed on
+	// addresses the last upstream hop binds with SOCKS5 BIND
+	Reverse []string
+
+	// TransparentListen, if set, is the address of a listener for
+	// connections redirected by the firewall, which are sent through the
+	// chain to their original destination. It only works on Linux.
+	TransparentListen string
+	// TProxyListen, if set, is the address of TCP and UDP listeners for
+	// traffic diverted by TPROXY rules. Linux only.
+	TProxyListen string
+
+	// ProxyProtocol lists the CIDRs or addresses of load balancers whose
+	// connections to the listener start with a PROXY protocol v1 or v2
+	// header. The client address from the header replaces theirs.
+	ProxyProtocol []string
+	// Listeners are the addresses the proxy accepts clients on, replacing
+	// LocalHost and LocalPort when set
+	Listeners []Listener
+
+	// LocalUsers maps usernames allowed on the local listener to their
+	// bcrypt hashes. It is persisted separately in the local_users file.
+	LocalUsers map[string]string `json:"-"`
 }
 
 // getConfigPath is a variable so it can be overridden in tests
@@ -53,6 +389,13 @@ func SetConfigPathForTesting(fn func() (string, error)) {
 }
 
 func LoadOrCreate(username, password, encpass, upstreamHost string, upstreamPort int) (*Config, error) {
+	return LoadOrCreateWith(username, password, encpass, upstreamHost, upstreamPort, nil)
+}
+
+// LoadOrCreateWith is LoadOrCreate with a hook that can change settings
+// without a parameter of their own. apply runs after the parameters have
+// been applied, before the configuration is validated and saved.
+func LoadOrCreateWith(username, password, encpass, upstreamHost string, upstreamPort int, apply func(*Config) error) (*Config, error) {
 	configPath, err := getConfigPath()
 	if err != nil {
 		return nil, err
@@ -96,10 +439,7 @@ func LoadOrCreate(username, password, encpass, upstreamHost string, upstreamPort
 		if err != nil {
 			return nil, fmt.Errorf("failed to read config file: %v", err)
 		}
-		var hostConfig struct {
-			UpstreamHost string `json:"upstream_host"`
-			UpstreamPort int    `json:"upstream_port"`
-		}
+		var hostConfig hostConfig
 		if err := json.Unmarshal(data, &hostConfig); err != nil {
 			return nil, fmt.Errorf("failed to parse config file: %v", err)
 		}
@@ -109,7 +449,77 @@ func LoadOrCreate(username, password, encpass, upstreamHost string, upstreamPort
 		if cfg.UpstreamPort == 0 {
 			cfg.UpstreamPort = hostConfig.UpstreamPort
 		}
+		if cfg.UpstreamType == "" {
+			cfg.UpstreamType = hostConfig.UpstreamType
+			cfg.UpstreamTLS = hostConfig.UpstreamTLS
+		}
+		if cfg.UpstreamTLSOptions == nil {
+			cfg.UpstreamTLSOptions = hostConfig.UpstreamTLSOptions
+		}
+		if cfg.ListenTLS == nil {
+			cfg.ListenTLS = hostConfig.ListenTLS
+		}
+		if len(cfg.Endpoints) == 0 {
+			cfg.Endpoints = hostConfig.Endpoints
+		}
+		if cfg.UpstreamWeight == 0 {
+			cfg.UpstreamWeight = hostConfig.UpstreamWeight
+		}
+		if cfg.Balance == "" {
+			cfg.Balance = hostConfig.Balance
+		}
+		if cfg.HealthCheckInterval == 0 {
+			cfg.HealthCheckInterval = hostConfig.HealthCheckInterval
+		}
+		if cfg.KnownHosts == "" {
+			cfg.KnownHosts = hostConfig.KnownHosts
+		}
+		if len(cfg.Chain) == 0 {
+			cfg.Chain = hostConfig.Chain
+		}
+		if len(cfg.Rules) == 0 {
+			cfg.Rules = hostConfig.Rules
+		}
+		if len(cfg.Chains) == 0 {
+			cfg.Chains = hostConfig.Chains
+		}
+		if cfg.PACListen == "" {
+			cfg.PACListen = hostConfig.PACListen
+		}
+		if cfg.Resolve == "" {
+			cfg.Resolve = hostConfig.Resolve
+		}
+		if cfg.DNSListen == "" {
+			cfg.DNSListen = hostConfig.DNSListen
+		}
+		if cfg.DNSResolver == "" {
+			cfg.DNSResolver = hostConfig.DNSResolver
+		}
+		if len(cfg.Forwards) == 0 {
+			cfg.Forwards = hostConfig.Forwards
+		}
+		if len(cfg.Reverse) == 0 {
+			cfg.Reverse = hostConfig.Reverse
+		}
+		if cfg.TransparentListen == "" {
+			cfg.TransparentListen = hostConfig.TransparentListen
+		}
+		if cfg.TProxyListen == "" {
+			cfg.TProxyListen = hostConfig.TProxyListen
+		}
+		if len(cfg.ProxyProtocol) == 0 {
+			cfg.ProxyProtocol = hostConfig.ProxyProtocol
+		}
+		if len(cfg.Listeners) == 0 {
+			cfg.Listeners = hostConfig.Listeners
+		}
+	}
+
+	users, err := LoadLocalUsers()
+	if err != nil {
+		return nil, err
 	}
+	cfg.LocalUsers = users
 
 	// Update config with new values if provided
 	if upstreamHost != "" {
@@ -124,25 +534,89 @@ func LoadOrCreate(username, password, encpass, upstreamHost string, upstreamPort
 	if password != "" {
 		cfg.Password = password
 	}
+	if apply != nil {
+		if err := apply(cfg); err != nil {
+			return nil, err
+		}
+	}
 
 	// Validate required fields
 	if cfg.UpstreamHost == "" || cfg.UpstreamPort == 0 {
 		return nil, fmt.Errorf("upstream host and port are required")
 	}
-	if cfg.Username == "" || cfg.Password == "" {
-		return nil, fmt.Errorf("username and password are required")
+	// Credentials are optional for upstreams that don't require auth,
+	// but a username without a password (or vice versa) is a mistake. SSH
+	// upstreams may use a private key instead of a password.
+	if (cfg.Username == "") != (cfg.Password == "" && cfg.PrivateKey == "") {
+		return nil, fmt.Errorf("username and password must be provided together")
 	}
-
-	// Save configs
-	hostConfig := struct {
-		UpstreamHost string `json:"upstream_host"`
-		UpstreamPort int    `json:"upstream_port"`
-	}{
-		UpstreamHost: cfg.UpstreamHost,
-		UpstreamPort: cfg.UpstreamPort,
+	for _, hop := range cfg.Hops() {
+		if err := hop.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ListenTLS != nil && (cfg.ListenTLS.CertFile == "" || cfg.ListenTLS.KeyFile == "") {
+		return nil, fmt.Errorf("listener TLS requires a certificate and a key")
+	}
+	if err := ValidateBalance(cfg.Balance); err != nil {
+		return nil, err
+	}
+	switch cfg.Resolve {
+	case "", ResolveRemote, ResolveLocal, ResolvePreserve:
+	default:
+		return nil, fmt.Errorf("unknown resolution mode %q (want remote, local or preserve)", cfg.Resolve)
+	}
+	if cfg.DNSResolver != "" {
+		if _, _, err := parseHostPort(cfg.DNSResolver); err != nil {
+			return nil, fmt.Errorf("invalid DNS resolver: %v", err)
+		}
+	}
+	for _, endpoint := range cfg.UpstreamEndpoints() {
+		if endpoint.Weight < 0 {
+			return nil, fmt.Errorf("endpoint %s has a negative weight", endpoint.Addr())
+		}
+	}
+	for name, hops := range cfg.Chains {
+		if len(hops) == 0 {
+			return nil, fmt.Errorf("chain %s has no hops", name)
+		}
+		for _, hop := range hops {
+			if err := hop.validate(); err != nil {
+				return nil, fmt.Errorf("chain %s: %v", name, err)
+			}
+		}
+	}
+	for _, rule := range cfg.Rules {
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := cfg.Chains[rule.Chain]; rule.Action == RouteChain && !ok {
+			return nil, fmt.Errorf("routing rule uses unknown chain %q", rule.Chain)
+		}
+	}
+	for _, forward := range cfg.Forwards {
+		if err := forward.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range cfg.ProxyProtocol {
+		if _, err := ParseNetwork(entry); err != nil {
+			return nil, fmt.Errorf("invalid PROXY protocol source: %v", err)
+		}
+	}
+	for _, listener := range cfg.Listeners {
+		if err := listener.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, target := range cfg.Reverse {
+		if _, _, err := parseHostPort(target); err != nil {
+			return nil, fmt.Errorf("invalid reverse tunnel target: %v", err)
+		}
 	}
 
-	data, err := json.Marshal(hostConfig)
+	// Save configs
+	data, err := json.Marshal(newHostConfig(cfg))
 	if err != nil {
 		return nil, err
 	}
@@ -213,6 +687,19 @@ func decrypt(encData []byte, password string) ([]byte, error) {
 	return gcm.Open(nil, nonce, ciphertext, nil)
 }
 
+// ResolvePath returns name inside the config directory, or name itself if
+// it is an absolute path
+func ResolvePath(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	configPath, err := getConfigPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configPath, name), nil
+}
+
 // ConfigExists checks if configuration files exist
 func ConfigExists() bool {
 	configPath, err := getConfigPath()
@@ -244,15 +731,7 @@ func SaveConfig(cfg *Config, encpass string) error {
 	credsFilePath := filepath.Join(configPath, credsFile)
 
 	// Save host/port config
-	hostConfig := struct {
-		UpstreamHost string `json:"upstream_host"`
-		UpstreamPort int    `json:"upstream_port"`
-	}{
-		UpstreamHost: cfg.UpstreamHost,
-		UpstreamPort: cfg.UpstreamPort,
-	}
-
-	data, err := json.Marshal(hostConfig)
+	data, err := json.Marshal(newHostConfig(cfg))
 	if err != nil {
 		return err
 	}
@@ -277,3 +756,240 @@ func SaveConfig(cfg *Config, encpass string) error {
 
 	return nil
 }
+
+// UpstreamEndpoints returns every address of the primary upstream, starting
+// with UpstreamHost and UpstreamPort
+func (c *Config) UpstreamEndpoints() []Endpoint {
+	endpoints := []Endpoint{{Host: c.UpstreamHost, Port: c.UpstreamPort, Weight: c.UpstreamWeight}}
+	return append(endpoints, c.Endpoints...)
+}
+
+// HopsVia returns the upstream chain with the primary upstream reached at
+// the given endpoint
+func (c *Config) HopsVia(endpoint Endpoint) []Hop {
+	hops := c.Hops()
+	hops[0].Host, hops[0].Port = endpoint.Host, endpoint.Port
+	return hops
+}
+
+// Hops returns the full upstream chain in dialing order, starting with the
+// primary upstream
+func (c *Config) Hops() []Hop {
+	hops := []Hop{{
+		Host:     c.UpstreamHost,
+		Port:     c.UpstreamPort,
+		Username: c.Username,
+		Password: c.Password,
+		Type:     c.UpstreamType,
+		TLS:      c.UpstreamTLS,
+
+		TLSOptions: c.UpstreamTLSOptions,
+		PrivateKey: c.PrivateKey,
+		KnownHosts: c.KnownHosts,
+	}}
+	return append(hops, c.Chain...)
+}
+
+// ParseHops parses a comma-separated list of [scheme://][user:pass@]host:port
+// hops, where scheme is one accepted by ParseHopType
+func ParseHops(s string) ([]Hop, error) {
+	var hops []Hop
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var hop Hop
+		if scheme, rest, ok := strings.Cut(part, "://"); ok {
+			hopType, useTLS, err := ParseHopType(scheme)
+			if err != nil {
+				return nil, err
+			}
+			hop.Type, hop.TLS = hopType, useTLS
+			part = rest
+		}
+		if at := strings.LastIndex(part, "@"); at >= 0 {
+			userinfo := part[:at]
+			part = part[at+1:]
+			user, pass, ok := strings.Cut(userinfo, ":")
+			if !ok || user == "" {
+				return nil, fmt.Errorf("invalid credentials in hop %q", part)
+			}
+			hop.Username, hop.Password = user, pass
+		}
+
+		host, port, err := parseHostPort(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hop address: %v", err)
+		}
+		hop.Host, hop.Port = host, port
+		hops = append(hops, hop)
+	}
+	return hops, nil
+}
+
+// ParseEndpoints parses a comma-separated list of host:port[*weight]
+// endpoints
+func ParseEndpoints(s string) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var endpoint Endpoint
+		if addr, weight, ok := strings.Cut(part, "*"); ok {
+			w, err := strconv.Atoi(weight)
+			if err != nil || w <= 0 {
+				return nil, fmt.Errorf("invalid weight in endpoint %q", part)
+			}
+			endpoint.Weight = w
+			part = addr
+		}
+		host, port, err := parseHostPort(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint: %v", err)
+		}
+		endpoint.Host, endpoint.Port = host, port
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// ValidateBalance checks that name is one of BalanceStrategies or empty
+func ValidateBalance(name string) error {
+	if name == "" {
+		return nil
+	}
+	for _, strategy := range BalanceStrategies {
+		if name == strategy {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown balancing strategy %q (want one of %s)", name, strings.Join(BalanceStrategies, ", "))
+}
+
+// parseHostPort splits a host:port address and checks the port
+func parseHostPort(addr string) (string, int, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("%q: %v", addr, err)
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum <= 0 || portNum > 65535 || host == "" {
+		return "", 0, fmt.Errorf("%q: invalid host or port", addr)
+	}
+	return host, portNum, nil
+}
+
+// LocalAuthRequired reports whether clients of the local listener must
+// authenticate with a username and password.
+func (c *Config) LocalAuthRequired() bool {
+	return len(c.LocalUsers) > 0
+}
+
+// VerifyLocalUser checks a username/password pair against the local users
+func (c *Config) VerifyLocalUser(username, password string) bool {
+	hash, ok := c.LocalUsers[username]
+	if !ok {
+		// Compare against a dummy hash so unknown users take as long as known ones
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// LoadLocalUsers reads the local user hashes from the config directory.
+// A missing file yields an empty set of users.
+func LoadLocalUsers() (map[string]string, error) {
+	configPath, err := getConfigPath()
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string]string{}
+	data, err := os.ReadFile(filepath.Join(configPath, usersFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return users, nil
+		}
+		return nil, fmt.Errorf("failed to read local users file: %v", err)
+	}
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("failed to parse local users file: %v", err)
+	}
+	return users, nil
+}
+
+// SetLocalUser adds or updates a local user, storing a bcrypt hash of the password
+func SetLocalUser(username, password string) error {
+	if username == "" || password == "" {
+		return fmt.Errorf("username and password are required")
+	}
+	// RFC 1929 limits both fields to 255 bytes
+	if len(username) > 255 || len(password) > 255 {
+		return fmt.Errorf("username and password must be at most 255 bytes")
+	}
+
+	users, err := LoadLocalUsers()
+	if err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	users[username] = string(hash)
+	return saveLocalUsers(users)
+}
+
+// RemoveLocalUser deletes a local user
+func RemoveLocalUser(username string) error {
+	users, err := LoadLocalUsers()
+	if err != nil {
+		return err
+	}
+	if _, ok := users[username]; !ok {
+		return fmt.Errorf("local user %q not found", username)
+	}
+	delete(users, username)
+	return saveLocalUsers(users)
+}
+
+// LocalUserNames returns the configured local usernames in sorted order
+func LocalUserNames() ([]string, error) {
+	users, err := LoadLocalUsers()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func saveLocalUsers(users map[string]string) error {
+	if err := EnsureConfigDir(); err != nil {
+		return err
+	}
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(configPath, usersFile), data, 0600)
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Forward is a static port forward: connections accepted on Listen are
+// sent through the chain to Target, without any proxy handshake
+type Forward struct {
+	Listen string `json:"listen"`
+	Target string `json:"target"`
+}
+
+// String formats the forward in the syntax accepted by ParseForwards
+func (f Forward) String() string {
+	return f.Listen + "=" + f.Target
+}
+
+func (f Forward) validate() error {
+	if _, _, err := parseHostPort(f.Listen); err != nil {
+		return fmt.Errorf("invalid forward listen address: %v", err)
+	}
+	if _, _, err := parseHostPort(f.Target); err != nil {
+		return fmt.Errorf("invalid forward target: %v", err)
+	}
+	return nil
+}
+
+// ParseForwards parses comma-separated static forwards of the form
+// "listen=target", such as "127.0.0.1:5432=db.internal:5432". A listen
+// address that is only a port binds to 127.0.0.1.
+func ParseForwards(s string) ([]Forward, error) {
+	var forwards []Forward
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		listen, target, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid forward %q, want listen=target", part)
+		}
+		listen, target = strings.TrimSpace(listen), strings.TrimSpace(target)
+		if !strings.Contains(listen, ":") {
+			listen = net.JoinHostPort("127.0.0.1", listen)
+		}
+		forward := Forward{Listen: listen, Target: target}
+		if err := forward.validate(); err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, forward)
+	}
+	return forwards, nil
+}
+
+// FormatForwards formats forwards in the syntax accepted by ParseForwards
+func FormatForwards(forwards []Forward) string {
+	parts := make([]string, len(forwards))
+	for i, forward := range forwards {
+		parts[i] = forward.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseReverse parses comma-separated host:port targets of reverse tunnels
+func ParseReverse(s string) ([]string, error) {
+	var targets []string
+	for _, target := range strings.Split(s, ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+		if _, _, err := parseHostPort(target); err != nil {
+			return nil, fmt.Errorf("invalid reverse tunnel target: %v", err)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestParseForwards(t *testing.T) {
+	forwards, err := ParseForwards("127.0.0.1:5432=db.internal:5432, 6379=cache.internal:6379,[::1]:8080=[2001:db8::1]:80")
+	if err != nil {
+		t.Fatalf("ParseForwards() error = %v", err)
+	}
+	want := []Forward{
+		{Listen: "127.0.0.1:5432", Target: "db.internal:5432"},
+		{Listen: "127.0.0.1:6379", Target: "cache.internal:6379"},
+		{Listen: "[::1]:8080", Target: "[2001:db8::1]:80"},
+	}
+	if len(forwards) != len(want) {
+		t.Fatalf("ParseForwards() = %v, want %v", forwards, want)
+	}
+	for i := range want {
+		if forwards[i] != want[i] {
+			t.Errorf("Forward %d = %v, want %v", i, forwards[i], want[i])
+		}
+	}
+
+	round, err := ParseForwards(FormatForwards(forwards))
+	if err != nil || len(round) != len(forwards) {
+		t.Fatalf("ParseForwards(FormatForwards()) = %v, %v", round, err)
+	}
+	for i := range forwards {
+		if round[i] != forwards[i] {
+			t.Errorf("Round-tripped forward %d = %v, want %v", i, round[i], forwards[i])
+		}
+	}
+
+	for _, invalid := range []string{
+		"5432",
+		"5432=db.internal",
+		"0=db.internal:5432",
+		"127.0.0.1:5432=:5432",
+	} {
+		if _, err := ParseForwards(invalid); err == nil {
+			t.Errorf("ParseForwards(%q) succeeded, want an error", invalid)
+		}
+	}
+}
+
+func TestParseReverse(t *testing.T) {
+	targets, err := ParseReverse("localhost:8080, 127.0.0.1:3000")
+	if err != nil {
+		t.Fatalf("ParseReverse() error = %v", err)
+	}
+	if len(targets) != 2 || targets[0] != "localhost:8080" || targets[1] != "127.0.0.1:3000" {
+		t.Errorf("ParseReverse() = %v, want both targets", targets)
+	}
+	if _, err := ParseReverse("localhost"); err == nil {
+		t.Error("ParseReverse() accepted a target without a port")
+	}
+}
+
+func TestForwardPersistence(t *testing.T) {
+	tempDir := t.TempDir()
+	originalGetConfigPath := GetConfigPath()
+	SetConfigPathForTesting(func() (string, error) { return tempDir, nil })
+	defer SetConfigPathForTesting(originalGetConfigPath)
+
+	forward := Forward{Listen: "127.0.0.1:5432", Target: "db.internal:5432"}
+	_, err := LoadOrCreateWith("", "", "", "gw.example.com", 1080, func(cfg *Config) error {
+		cfg.Forwards = []Forward{forward}
+		cfg.Reverse = []string{"localhost:8080"}
+		cfg.TransparentListen = "127.0.0.1:12345"
+		cfg.TProxyListen = "0.0.0.0:12346"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("LoadOrCreateWith() error = %v", err)
+	}
+
+	cfg, err := LoadOrCreate("", "", "", "", 0)
+	if err != nil {
+		t.Fatalf("LoadOrCreate() error = %v", err)
+	}
+	if len(cfg.Forwards) != 1 || cfg.Forwards[0] != forward {
+		t.Errorf("Forwards = %v, want the saved forward", cfg.Forwards)
+	}
+	if len(cfg.Reverse) != 1 || cfg.Reverse[0] != "localhost:8080" {
+		t.Errorf("Reverse = %v, want the saved target", cfg.Reverse)
+	}
+	if cfg.TransparentListen != "127.0.0.1:12345" {
+		t.Errorf("TransparentListen = %q, want the saved address", cfg.TransparentListen)
+	}
+	if cfg.TProxyListen != "0.0.0.0:12346" {
+		t.Errorf("TProxyListen = %q, want the saved address", cfg.TProxyListen)
+	}
+
+	_, err = LoadOrCreateWith("", "", "", "", 0, func(cfg *Config) error {
+		cfg.Forwards = []Forward{{Listen: "127.0.0.1:5432", Target: "db.internal"}}
+		return nil
+	})
+	if err == nil {
+		t.Error("LoadOrCreateWith() accepted a forward target without a port")
+	}
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// unixPrefix marks the address of a listener on a Unix domain socket
+const unixPrefix = "unix:"
+
+// Listener is an address the proxy accepts clients on. Every listener
+// serves the same protocols, and the listener criterion of routing rules
+// can tell their clients apart.
+type Listener struct {
+	// Address is a host:port, or unix:path for a Unix domain socket
+	Address string `json:"address"`
+	// Name identifies the listener to routing rules, which can also use its
+	// address
+	Name string `json:"name,omitempty"`
+	// Mode and Owner set the permissions, in octal, and the owner, as user
+	// or user:group, of a Unix domain socket
+	Mode  string `json:"mode,omitempty"`
+	Owner string `json:"owner,omitempty"`
+	// NoAuth lets clients in without local authentication even when local
+	// users exist, for example on a socket only trusted users can open
+	NoAuth bool `json:"no_auth,omitempty"`
+}
+
+// Network returns "unix" for a Unix domain socket and "tcp" otherwise
+func (l Listener) Network() string {
+	if strings.HasPrefix(l.Address, unixPrefix) {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// Path returns the address without the unix: prefix of a Unix domain socket
+func (l Listener) Path() string {
+	return strings.TrimPrefix(l.Address, unixPrefix)
+}
+
+// ID returns the name of the listener, or its address if it has none
+func (l Listener) ID() string {
+	if l.Name != "" {
+		return l.Name
+	}
+	return l.Address
+}
+
+// FileMode parses Mode. It returns 0 when Mode is empty.
+func (l Listener) FileMode() (uint32, error) {
+	if l.Mode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(l.Mode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid socket mode %q", l.Mode)
+	}
+	return uint32(mode), nil
+}
+
+func (l Listener) validate() error {
+	if l.Network() == "unix" {
+		if l.Path() == "" {
+			return fmt.Errorf("listener %q has no socket path", l.Address)
+		}
+		_, err := l.FileMode()
+		return err
+	}
+	if l.Mode != "" || l.Owner != "" {
+		return fmt.Errorf("listener %s: mode and owner only apply to Unix domain sockets", l.Address)
+	}
+	if _, _, err := parseHostPort(l.Address); err != nil {
+		return fmt.Errorf("invalid listen address: %v", err)
+	}
+	return nil
+}
+
+// String formats the listener in the syntax accepted by ParseListeners
+func (l Listener) String() string {
+	parts := []string{l.Address}
+	for _, option := range []struct{ key, value string }{
+		{"name", l.Name},
+		{"mode", l.Mode},
+		{"owner", l.Owner},
+	} {
+		if option.value != "" {
+			parts = append(parts, option.key+"="+option.value)
+		}
+	}
+	if l.NoAuth {
+		parts = append(parts, "auth=none")
+	}
+	return strings.Join(parts, " ")
+}
+
+// ParseListeners parses semicolon-separated listeners of the form
+// "address [option=value]...". The address is host:port or unix:path, and
+// the options are name, mode, owner and auth=none. For example:
+// "127.0.0.1:1080; [::1]:1080; unix:/run/proxy.sock mode=0660 auth=none".
+func ParseListeners(s string) ([]Listener, error) {
+	var listeners []Listener
+	for _, part := range strings.Split(s, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+
+		listener := Listener{Address: fields[0]}
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok || value == "" {
+				return nil, fmt.Errorf("invalid option %q for listener %s", field, listener.Address)
+			}
+			switch key {
+			case "name":
+				listener.Name = value
+			case "mode":
+				listener.Mode = value
+			case "owner":
+				listener.Owner = value
+			case "auth":
+				if value != "none" {
+					return nil, fmt.Errorf("invalid auth %q for listener %s, only none is supported", value, listener.Address)
+				}
+				listener.NoAuth = true
+			default:
+				return nil, fmt.Errorf("unknown option %q for listener %s", key, listener.Address)
+			}
+		}
+		if err := listener.validate(); err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// FormatListeners formats listeners in the syntax accepted by ParseListeners
+func FormatListeners(listeners []Listener) string {
+	parts := make([]string, len(listeners))
+	for i, listener := range listeners {
+		parts[i] = listener.String()
+	}
+	return strings.Join(parts, "; ")
+}
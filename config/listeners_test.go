@@ -0,0 +1,92 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestParseListeners(t *testing.T) {
+	listeners, err := ParseListeners("127.0.0.1:1080; [::1]:1080 name=v6 ;unix:/run/proxy.sock mode=0660 owner=root:proxy auth=none")
+	if err != nil {
+		t.Fatalf("ParseListeners() error = %v", err)
+	}
+	want := []Listener{
+		{Address: "127.0.0.1:1080"},
+		{Address: "[::1]:1080", Name: "v6"},
+		{Address: "unix:/run/proxy.sock", Mode: "0660", Owner: "root:proxy", NoAuth: true},
+	}
+	if len(listeners) != len(want) {
+		t.Fatalf("ParseListeners() = %v, want %v", listeners, want)
+	}
+	for i := range want {
+		if listeners[i] != want[i] {
+			t.Errorf("Listener %d = %+v, want %+v", i, listeners[i], want[i])
+		}
+	}
+	if got := listeners[2].Network(); got != "unix" {
+		t.Errorf("Network() = %q, want unix", got)
+	}
+	if got := listeners[2].Path(); got != "/run/proxy.sock" {
+		t.Errorf("Path() = %q, want /run/proxy.sock", got)
+	}
+	if got := listeners[1].ID(); got != "v6" {
+		t.Errorf("ID() = %q, want the name", got)
+	}
+	if got := listeners[0].ID(); got != "127.0.0.1:1080" {
+		t.Errorf("ID() = %q, want the address", got)
+	}
+
+	round, err := ParseListeners(FormatListeners(listeners))
+	if err != nil || len(round) != len(listeners) {
+		t.Fatalf("ParseListeners(FormatListeners()) = %v, %v", round, err)
+	}
+	for i := range listeners {
+		if round[i] != listeners[i] {
+			t.Errorf("Round-tripped listener %d = %+v, want %+v", i, round[i], listeners[i])
+		}
+	}
+
+	for _, invalid := range []string{
+		"localhost",
+		"unix:",
+		"unix:/run/proxy.sock mode=0999",
+		"127.0.0.1:1080 mode=0660",
+		"127.0.0.1:1080 auth=required",
+		"127.0.0.1:1080 tls",
+	} {
+		if _, err := ParseListeners(invalid); err == nil {
+			t.Errorf("ParseListeners(%q) succeeded, want an error", invalid)
+		}
+	}
+}
+
+func TestListenerPersistence(t *testing.T) {
+	tempDir := t.TempDir()
+	originalGetConfigPath := GetConfigPath()
+	SetConfigPathForTesting(func() (string, error) { return tempDir, nil })
+	defer SetConfigPathForTesting(originalGetConfigPath)
+
+	listener := Listener{Address: "unix:/run/proxy.sock", Mode: "0660", NoAuth: true}
+	_, err := LoadOrCreateWith("", "", "", "gw.example.com", 1080, func(cfg *Config) error {
+		cfg.Listeners = []Listener{{Address: "127.0.0.1:1080"}, listener}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("LoadOrCreateWith() error = %v", err)
+	}
+
+	cfg, err := LoadOrCreate("", "", "", "", 0)
+	if err != nil {
+		t.Fatalf("LoadOrCreate() error = %v", err)
+	}
+	if len(cfg.Listeners) != 2 || cfg.Listeners[1] != listener {
+		t.Errorf("Listeners = %+v, want the saved listeners", cfg.Listeners)
+	}
+
+	_, err = LoadOrCreateWith("", "", "", "", 0, func(cfg *Config) error {
+		cfg.Listeners = []Listener{{Address: "127.0.0.1"}}
+		return nil
+	})
+	if err == nil {
+		t.Error("LoadOrCreateWith() accepted a listener without a port")
+	}
+}
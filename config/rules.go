@@ -0,0 +1,252 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Routing actions
+const (
+	// RouteUpstream sends the connection through the upstream chain, which
+	// is what happens when no rule matches
+	RouteUpstream = "upstream"
+	// RouteDirect connects to the target from this machine
+	RouteDirect = "direct"
+	// RouteChain sends the connection through the named entry of Chains
+	RouteChain = "chain"
+	// RouteReject refuses the connection
+	RouteReject = "reject"
+)
+
+// Rule routes the connections it matches. A rule matches when each of its
+// non-empty criteria does, and a criterion matches when any of its entries
+// does, so a rule without criteria matches everything.
+type Rule struct {
+	// Domains match the target's host name: "example.com" matches the
+	// domain and its subdomains, and patterns with * are wildcards, where
+	// * also matches dots
+	Domains []string `json:"domains,omitempty"`
+	// Networks match the target's IP address, as CIDRs or single addresses.
+	// Host names are not resolved to match them.
+	Networks []string `json:"networks,omitempty"`
+	// Ports match the target's port, as single ports or lo-hi ranges
+	Ports []string `json:"ports,omitempty"`
+	// Sources match the client's IP address, as CIDRs or single addresses
+	Sources []string `json:"sources,omitempty"`
+	// Listeners match the local listener the client connected to, by name
+	// or address
+	Listeners []string `json:"listeners,omitempty"`
+
+	Action string `json:"action"`
+	// Chain names the entry of Config.Chains a RouteChain rule uses
+	Chain string `json:"chain,omitempty"`
+}
+
+// Match reports whether the rule matches a connection to host and port from
+// the client at source, which may be nil, accepted by listener, which is
+// empty for connections that didn't come through a local listener
+func (r Rule) Match(listener string, source net.IP, host string, port int) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	ip := net.ParseIP(host)
+	return matchAny(r.Domains, func(pattern string) bool { return ip == nil && matchDomain(pattern, host) }) &&
+		matchAny(r.Networks, func(entry string) bool { return matchNetwork(entry, ip) }) &&
+		matchAny(r.Ports, func(entry string) bool { return matchPort(entry, port) }) &&
+		matchAny(r.Sources, func(entry string) bool { return matchNetwork(entry, source) }) &&
+		matchAny(r.Listeners, func(entry string) bool { return listener != "" && entry == listener })
+}
+
+// matchAny reports whether match accepts any of entries. An empty list
+// doesn't restrict anything.
+func matchAny(entries []string, match func(string) bool) bool {
+	if len(entries) == 0 {
+		return true
+	}
+	for _, entry := range entries {
+		if match(entry) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDomain(pattern, host string) bool {
+	pattern = strings.TrimPrefix(strings.ToLower(pattern), ".")
+	if strings.Contains(pattern, "*") {
+		ok, _ := path.Match(pattern, host)
+		return ok
+	}
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+func matchNetwork(entry string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	network, err := ParseNetwork(entry)
+	return err == nil && network.Contains(ip)
+}
+
+func matchPort(entry string, port int) bool {
+	lo, hi, err := ParsePortRange(entry)
+	return err == nil && port >= lo && port <= hi
+}
+
+// ParseNetwork parses a network entry of a rule, a CIDR or a single IP address
+func ParseNetwork(entry string) (*net.IPNet, error) {
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		return network, err
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", entry)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// ParsePortRange parses a port entry of a rule, a port or a lo-hi range
+func ParsePortRange(entry string) (int, int, error) {
+	loStr, hiStr, isRange := strings.Cut(entry, "-")
+	if !isRange {
+		hiStr = loStr
+	}
+	lo, err1 := strconv.Atoi(loStr)
+	hi, err2 := strconv.Atoi(hiStr)
+	if err1 != nil || err2 != nil || lo <= 0 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid port or port range %q", entry)
+	}
+	return lo, hi, nil
+}
+
+// validate checks the rule's action and criteria. Whether its chain exists
+// is checked with the rest of the configuration.
+func (r Rule) validate() error {
+	switch r.Action {
+	case RouteUpstream, RouteDirect, RouteReject:
+	case RouteChain:
+		if r.Chain == "" {
+			return fmt.Errorf("routing rule needs a chain name")
+		}
+	default:
+		return fmt.Errorf("unknown routing action %q", r.Action)
+	}
+	for _, pattern := range r.Domains {
+		if strings.TrimPrefix(pattern, ".") == "" {
+			return fmt.Errorf("empty domain in routing rule")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid domain pattern %q", pattern)
+		}
+	}
+	for _, entry := range append(append([]string(nil), r.Networks...), r.Sources...) {
+		if _, err := ParseNetwork(entry); err != nil {
+			return err
+		}
+	}
+	for _, entry := range r.Ports {
+		if _, _, err := ParsePortRange(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseRules parses semicolon-separated routing rules of the form
+// "action [criterion=entry,entry...]...". The action is upstream, direct,
+// reject or chain:name, and the criteria are domain, net, port, source and
+// listener.
+// For example: "direct domain=localhost net=10.0.0.0/8; reject port=25".
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, part := range strings.Split(s, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var rule Rule
+		rule.Action, rule.Chain, _ = strings.Cut(fields[0], ":")
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok || value == "" {
+				return nil, fmt.Errorf("invalid criterion %q in routing rule", field)
+			}
+			entries := strings.Split(value, ",")
+			switch key {
+			case "domain":
+				rule.Domains = append(rule.Domains, entries...)
+			case "net":
+				rule.Networks = append(rule.Networks, entries...)
+			case "port":
+				rule.Ports = append(rule.Ports, entries...)
+			case "source":
+				rule.Sources = append(rule.Sources, entries...)
+			case "listener":
+				rule.Listeners = append(rule.Listeners, entries...)
+			default:
+				return nil, fmt.Errorf("unknown criterion %q in routing rule", key)
+			}
+		}
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ParseChains parses semicolon-separated named chains of the form
+// "name=hops", where hops is a list accepted by ParseHops
+func ParseChains(s string) (map[string][]Hop, error) {
+	chains := make(map[string][]Hop)
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, list, ok := strings.Cut(part, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid named chain %q, want name=hops", part)
+		}
+		hops, err := ParseHops(list)
+		if err != nil {
+			return nil, fmt.Errorf("chain %s: %v", name, err)
+		}
+		if len(hops) == 0 {
+			return nil, fmt.Errorf("chain %s has no hops", name)
+		}
+		chains[name] = hops
+	}
+	return chains, nil
+}
+
+// String formats the rule in the syntax accepted by ParseRules
+func (r Rule) String() string {
+	parts := []string{r.Action}
+	if r.Action == RouteChain {
+		parts[0] += ":" + r.Chain
+	}
+	for _, criterion := range []struct {
+		key     string
+		entries []string
+	}{
+		{"domain", r.Domains},
+		{"net", r.Networks},
+		{"port", r.Ports},
+		{"source", r.Sources},
+		{"listener", r.Listeners},
+	} {
+		if len(criterion.entries) > 0 {
+			parts = append(parts, criterion.key+"="+strings.Join(criterion.entries, ","))
+		}
+	}
+	return strings.Join(parts, " ")
+}
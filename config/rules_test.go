@@ -0,0 +1,176 @@
+package config
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRuleMatch(t *testing.T) {
+	client := net.ParseIP("192.168.1.20")
+	tests := []struct {
+		name   string
+		rule   Rule
+		source net.IP
+		host   string
+		port   int
+		want   bool
+	}{
+		{"Empty rule matches everything", Rule{}, nil, "example.com", 443, true},
+		{"Domain itself", Rule{Domains: []string{"example.com"}}, nil, "example.com", 443, true},
+		{"Subdomain", Rule{Domains: []string{"example.com"}}, nil, "www.EXAMPLE.com.", 443, true},
+		{"Leading dot", Rule{Domains: []string{".example.com"}}, nil, "a.b.example.com", 443, true},
+		{"Not a label boundary", Rule{Domains: []string{"example.com"}}, nil, "badexample.com", 443, false},
+		{"Wildcard", Rule{Domains: []string{"*.corp.*"}}, nil, "git.eu.corp.example.net", 22, true},
+		{"Wildcard mismatch", Rule{Domains: []string{"*.corp.*"}}, nil, "corp.example.net", 22, false},
+		{"Domain against an IP", Rule{Domains: []string{"10.0.0.1"}}, nil, "10.0.0.1", 80, false},
+		{"CIDR", Rule{Networks: []string{"10.0.0.0/8"}}, nil, "10.1.2.3", 80, true},
+		{"Single address", Rule{Networks: []string{"::1"}}, nil, "::1", 80, true},
+		{"CIDR against a name", Rule{Networks: []string{"127.0.0.0/8"}}, nil, "localhost", 80, false},
+		{"Port", Rule{Ports: []string{"22", "8000-8100"}}, nil, "example.com", 8080, true},
+		{"Port mismatch", Rule{Ports: []string{"22", "8000-8100"}}, nil, "example.com", 443, false},
+		{"Source", Rule{Sources: []string{"192.168.0.0/16"}}, client, "example.com", 443, true},
+		{"Unknown source", Rule{Sources: []string{"192.168.0.0/16"}}, nil, "example.com", 443, false},
+		{"All criteria", Rule{Domains: []string{"example.com"}, Ports: []string{"443"}, Sources: []string{"192.168.1.20"}}, client, "example.com", 443, true},
+		{"One criterion fails", Rule{Domains: []string{"example.com"}, Ports: []string{"80"}}, client, "example.com", 443, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Match("", tt.source, tt.host, tt.port); got != tt.want {
+				t.Errorf("Match(%v, %q, %d) = %v, want %v", tt.source, tt.host, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleMatchListener(t *testing.T) {
+	rule := Rule{Listeners: []string{"public", "unix:/run/proxy.sock"}}
+	for _, tt := range []struct {
+		listener string
+		want     bool
+	}{
+		{"public", true},
+		{"unix:/run/proxy.sock", true},
+		{"127.0.0.1:1080", false},
+		{"", false},
+	} {
+		if got := rule.Match(tt.listener, nil, "example.com", 443); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.listener, got, tt.want)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("direct domain=localhost,corp.example.com net=10.0.0.0/8 ; chain:tor domain=*.onion; reject port=25 source=192.0.2.1 listener=public;")
+	if err != nil {
+		t.Fatalf("ParseRules() error = %v", err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("ParseRules() returned %d rules, want 3", len(rules))
+	}
+	if r := rules[0]; r.Action != RouteDirect || len(r.Domains) != 2 || r.Domains[1] != "corp.example.com" || len(r.Networks) != 1 {
+		t.Errorf("Rule 1 = %+v", r)
+	}
+	if r := rules[1]; r.Action != RouteChain || r.Chain != "tor" || len(r.Domains) != 1 {
+		t.Errorf("Rule 2 = %+v", r)
+	}
+	if r := rules[2]; r.Action != RouteReject || r.Ports[0] != "25" || r.Sources[0] != "192.0.2.1" || r.Listeners[0] != "public" {
+		t.Errorf("Rule 3 = %+v", r)
+	}
+
+	for i, rule := range rules {
+		again, err := ParseRules(rule.String())
+		if err != nil || len(again) != 1 || again[0].String() != rule.String() {
+			t.Errorf("Rule %d String() = %q does not parse back", i+1, rule.String())
+		}
+	}
+
+	for _, input := range []string{
+		"proxy domain=example.com",
+		"chain domain=example.com",
+		"direct host=example.com",
+		"direct domain",
+		"direct net=10.0.0.0/33",
+		"reject port=70000",
+		"reject port=90-80",
+		"direct domain=[a",
+	} {
+		if _, err := ParseRules(input); err == nil {
+			t.Errorf("ParseRules(%q) accepted an invalid rule", input)
+		}
+	}
+}
+
+func TestParseChains(t *testing.T) {
+	chains, err := ParseChains("tor=127.0.0.1:9050; backup=user:pass@b.example.com:1080,http://c.example.com:8080")
+	if err != nil {
+		t.Fatalf("ParseChains() error = %v", err)
+	}
+	if len(chains) != 2 || len(chains["tor"]) != 1 || len(chains["backup"]) != 2 {
+		t.Fatalf("ParseChains() = %+v", chains)
+	}
+	if hop := chains["backup"][1]; hop.Type != HopTypeHTTP || hop.Addr() != "c.example.com:8080" {
+		t.Errorf("backup hop 2 = %+v", hop)
+	}
+
+	for _, input := range []string{"127.0.0.1:9050", "=127.0.0.1:9050", "tor=", "tor=localhost"} {
+		if _, err := ParseChains(input); err == nil {
+			t.Errorf("ParseChains(%q) accepted an invalid chain", input)
+		}
+	}
+}
+
+func TestRoutingPersistence(t *testing.T) {
+	tempDir := t.TempDir()
+	originalGetConfigPath := GetConfigPath()
+	SetConfigPathForTesting(func() (string, error) { return tempDir, nil })
+	defer SetConfigPathForTesting(originalGetConfigPath)
+
+	_, err := LoadOrCreateWith("", "", "", "gw.example.com", 1080, func(cfg *Config) error {
+		cfg.Chains = map[string][]Hop{"alt": {{Host: "alt.example.com", Port: 1080, Username: "u", Password: "p"}}}
+		cfg.Rules = []Rule{{Domains: []string{"example.org"}, Action: RouteChain, Chain: "alt"}}
+		cfg.PACListen = "127.0.0.1:8081"
+		cfg.Resolve = ResolveLocal
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("LoadOrCreateWith() error = %v", err)
+	}
+
+	cfg, err := LoadOrCreate("", "", "", "", 0)
+	if err != nil {
+		t.Fatalf("LoadOrCreate() error = %v", err)
+	}
+	if len(cfg.Rules) != 1 || cfg.Rules[0].Chain != "alt" {
+		t.Errorf("Rules = %+v, want the saved rule", cfg.Rules)
+	}
+	if cfg.PACListen != "127.0.0.1:8081" {
+		t.Errorf("PACListen = %q, want the saved address", cfg.PACListen)
+	}
+	if cfg.Resolve != ResolveLocal {
+		t.Errorf("Resolve = %q, want %q", cfg.Resolve, ResolveLocal)
+	}
+	alt := cfg.Chains["alt"]
+	if len(alt) != 1 || alt[0].Addr() != "alt.example.com:1080" {
+		t.Fatalf("Chains = %+v, want the saved chain", cfg.Chains)
+	}
+	if alt[0].Password != "" {
+		t.Error("Chain credentials were stored without encryption")
+	}
+
+	_, err = LoadOrCreateWith("", "", "", "", 0, func(cfg *Config) error {
+		cfg.Rules = []Rule{{Action: RouteChain, Chain: "missing"}}
+		return nil
+	})
+	if err == nil {
+		t.Error("LoadOrCreateWith() accepted a rule for an unknown chain")
+	}
+
+	_, err = LoadOrCreateWith("", "", "", "", 0, func(cfg *Config) error {
+		cfg.Resolve = "upstream"
+		return nil
+	})
+	if err == nil {
+		t.Error("LoadOrCreateWith() accepted an unknown resolution mode")
+	}
+}
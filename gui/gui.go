@@ -40,6 +40,7 @@ type GUI struct {
 	hostEntry           *widget.Entry
 	portEntry           *widget.Entry
 	logFileEntry        *widget.Entry
+	forwardsEntry       *widget.Entry
 	logFileLabel        *widget.Label
 	updateLogFileButtons func()
 }
@@ -56,7 +57,7 @@ func (g *GUI) Run() {
 	g.window = g.app.NewWindow("Go SOCKS5 Chain Configuration")
 	g.window.SetIcon(resourceIconPng)
 	// Set fixed window size for non-scrollable layout
-	g.window.Resize(fyne.NewSize(650, 680))
+	g.window.Resize(fyne.NewSize(650, 720))
 	g.window.SetFixedSize(true)
 	g.window.CenterOnScreen()
 
@@ -172,6 +173,7 @@ func (g *GUI) showConfigurationEditor() {
 	originalLocalHost := "127.0.0.1"
 	originalLocalPort := "1080"
 	originalLogFile := ""
+	originalForwards := ""
 	if g.config != nil {
 		originalUsername = g.config.Username
 		originalPassword = g.config.Password
@@ -184,17 +186,18 @@ func (g *GUI) showConfigurationEditor() {
 			originalLocalPort = strconv.Itoa(g.config.LocalPort)
 		}
 		originalLogFile = g.config.LogFile
+		originalForwards = config.FormatForwards(g.config.Forwards)
 	}
 
 	// Create form fields
 	g.usernameEntry = widget.NewEntry()
-	g.usernameEntry.PlaceHolder = "SOCKS5 Username"
+	g.usernameEntry.PlaceHolder = "SOCKS5 Username (optional)"
 	if g.config != nil {
 		g.usernameEntry.Text = g.config.Username
 	}
 
 	g.passwordEntry = widget.NewPasswordEntry()
-	g.passwordEntry.PlaceHolder = "SOCKS5 Password"
+	g.passwordEntry.PlaceHolder = "SOCKS5 Password (optional)"
 	if g.config != nil {
 		g.passwordEntry.Text = g.config.Password
 	}
@@ -227,6 +230,10 @@ func (g *GUI) showConfigurationEditor() {
 		g.localPortEntry.Text = "1080"
 	}
 
+	g.forwardsEntry = widget.NewEntry()
+	g.forwardsEntry.PlaceHolder = "127.0.0.1:5432=db.internal:5432, ..."
+	g.forwardsEntry.Text = originalForwards
+
 	// Use a label with entry-like styling to avoid scrollbars
 	logFileText := "No log file selected"
 	if g.config != nil && g.config.LogFile != "" {
@@ -252,8 +259,8 @@ func (g *GUI) showConfigurationEditor() {
 	// Create save/update function
 	saveFunc := func() {
 		// Validate input
-		if g.usernameEntry.Text == "" || g.passwordEntry.Text == "" {
-			dialog.ShowError(fmt.Errorf("Username and password are required"), g.window)
+		if (g.usernameEntry.Text == "") != (g.passwordEntry.Text == "") {
+			dialog.ShowError(fmt.Errorf("Username and password must be provided together"), g.window)
 			return
 		}
 		if g.hostEntry.Text == "" {
@@ -273,17 +280,28 @@ func (g *GUI) showConfigurationEditor() {
 			return
 		}
 
-		// Update configuration
-		g.config = &config.Config{
-			Username:     g.usernameEntry.Text,
-			Password:     g.passwordEntry.Text,
-			UpstreamHost: g.hostEntry.Text,
-			UpstreamPort: port,
-			LocalHost:    g.localHostEntry.Text,
-			LocalPort:    localPort,
-			LogFile:      g.logFileEntry.Text,
+		forwards, err := config.ParseForwards(g.forwardsEntry.Text)
+		if err != nil {
+			dialog.ShowError(fmt.Errorf("Invalid port forwards: %v", err), g.window)
+			return
 		}
 
+		// Update configuration, keeping settings not shown in the form
+		// (such as the extra chain hops)
+		cfg := config.Config{}
+		if g.config != nil {
+			cfg = *g.config
+		}
+		cfg.Username = g.usernameEntry.Text
+		cfg.Password = g.passwordEntry.Text
+		cfg.UpstreamHost = g.hostEntry.Text
+		cfg.UpstreamPort = port
+		cfg.LocalHost = g.localHostEntry.Text
+		cfg.LocalPort = localPort
+		cfg.LogFile = g.logFileEntry.Text
+		cfg.Forwards = forwards
+		g.config = &cfg
+
 		// Save configuration
 		if err := g.saveConfiguration(); err != nil {
 			dialog.ShowError(err, g.window)
@@ -304,6 +322,7 @@ func (g *GUI) showConfigurationEditor() {
 		originalLocalHost = g.localHostEntry.Text
 		originalLocalPort = g.localPortEntry.Text
 		originalLogFile = g.logFileEntry.Text
+		originalForwards = g.forwardsEntry.Text
 
 		// Enable start button after successful save
 		if g.startButton != nil {
@@ -323,8 +342,7 @@ func (g *GUI) showConfigurationEditor() {
 		// Check if any field has changed from original
 		if g.isNewUser {
 			// For new users, check if required fields have values
-			hasChanges = g.usernameEntry.Text != "" && g.passwordEntry.Text != "" &&
-				g.hostEntry.Text != "" && g.portEntry.Text != ""
+			hasChanges = g.hostEntry.Text != "" && g.portEntry.Text != ""
 		} else {
 			// For existing users, check if any field differs from original
 			hasChanges = g.usernameEntry.Text != originalUsername ||
@@ -333,7 +351,8 @@ func (g *GUI) showConfigurationEditor() {
 				g.portEntry.Text != originalPort ||
 				g.localHostEntry.Text != originalLocalHost ||
 				g.localPortEntry.Text != originalLocalPort ||
-				g.logFileEntry.Text != originalLogFile
+				g.logFileEntry.Text != originalLogFile ||
+				g.forwardsEntry.Text != originalForwards
 		}
 
 		// Only enable save button if there are changes AND server is not running
@@ -356,6 +375,7 @@ func (g *GUI) showConfigurationEditor() {
 	g.localHostEntry.OnChanged = func(string) { checkChanges() }
 	g.localPortEntry.OnChanged = func(string) { checkChanges() }
 	g.logFileEntry.OnChanged = func(string) { checkChanges() }
+	g.forwardsEntry.OnChanged = func(string) { checkChanges() }
 
 	// Create modern form layout with cards and better spacing
 	formContent := container.NewVBox()
@@ -441,6 +461,7 @@ func (g *GUI) showConfigurationEditor() {
 	optionalCard := widget.NewCard("", "Optional Settings", container.NewVBox(
 		container.NewGridWithColumns(2,
 			widget.NewLabel("Log File:"), logFileContainer,
+			widget.NewLabel("Port Forwards:"), g.forwardsEntry,
 		),
 	))
 	formContent.Add(optionalCard)
@@ -563,6 +584,13 @@ func (g *GUI) setFormFieldsEnabled(enabled bool) {
 			g.localPortEntry.Disable()
 		}
 	}
+	if g.forwardsEntry != nil {
+		if enabled {
+			g.forwardsEntry.Enable()
+		} else {
+			g.forwardsEntry.Disable()
+		}
+	}
 	// Log file entry remains disabled as it's read-only
 	if g.browseButton != nil {
 		if enabled {
@@ -628,6 +656,12 @@ func (g *GUI) startServer() {
 
 	// Try to start the server first to check for immediate errors (like port in use)
 	localAddr := fmt.Sprintf("%s:%d", localHost, localPort)
+	inUse := fmt.Sprintf("port %d is", localPort)
+	// Configured listeners replace the local address, as on the command line
+	if len(cfg.Listeners) > 0 {
+		localAddr = ""
+		inUse = "the configured listeners are"
+	}
 
 	// Create a channel to communicate startup result
 	startupResult := make(chan error, 1)
@@ -655,7 +689,7 @@ func (g *GUI) startServer() {
 				g.setFormFieldsEnabled(true)
 
 				// Show detailed error message
-				errorMsg := fmt.Sprintf("Failed to start SOCKS5 proxy server:\n\n%v\n\nPlease ensure port %d is not already in use.", err, localPort)
+				errorMsg := fmt.Sprintf("Failed to start SOCKS5 proxy server:\n\n%v\n\nPlease ensure %s not already in use.", err, inUse)
 				dialog.ShowError(fmt.Errorf("%s", errorMsg), g.window)
 			}
 		case <-time.After(100 * time.Millisecond):
@@ -5,8 +5,10 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -52,6 +54,21 @@ func setupInteractiveConfig() (string, string, string, error) {
 	return username, password, encpass, nil
 }
 
+func setupLocalUser(username string) error {
+	password, err := readPassword(fmt.Sprintf("Enter password for local user %q: ", username))
+	if err != nil {
+		return err
+	}
+	confirm, err := readPassword("Confirm password: ")
+	if err != nil {
+		return err
+	}
+	if password != confirm {
+		return fmt.Errorf("passwords do not match")
+	}
+	return config.SetLocalUser(username, password)
+}
+
 func main() {
 	// Command line flags
 	showVersion := flag.Bool("version", false, "Show version information")
@@ -60,12 +77,43 @@ func main() {
 	encpass := flag.String("encpass", os.Getenv("SOCKS5CHAIN_PASSWORD"), "Password to encrypt/decrypt stored credentials")
 	upstreamHost := flag.String("upstream-host", "", "Upstream SOCKS5 proxy hostname")
 	upstreamPort := flag.Int("upstream-port", 0, "Upstream SOCKS5 proxy port")
+	upstreamEndpoints := flag.String("upstream-endpoints", "", "Further comma-separated host:port[*weight] addresses of the upstream (\"none\" clears them)")
+	upstreamWeight := flag.Int("upstream-weight", 0, "Weight of the upstream host and port among the upstream endpoints (default 1)")
+	balance := flag.String("balance", "", "How connections are spread across the upstream endpoints: "+strings.Join(config.BalanceStrategies, ", ")+" (default failover)")
+	healthCheckInterval := flag.Int("health-check-interval", 0, "Seconds between health checks of the upstream endpoints (default 30)")
+	upstreamType := flag.String("upstream-type", "", "Upstream proxy type: socks5, http, https (HTTP CONNECT over TLS) or ssh")
+	upstreamTLS := flag.Bool("upstream-tls", false, "Connect to the upstream over TLS")
+	tlsServerName := flag.String("tls-server-name", "", "Server name to send and verify for a TLS upstream (default: upstream host)")
+	tlsCA := flag.String("tls-ca", "", "PEM CA bundle for verifying a TLS upstream, relative to the config directory")
+	tlsPins := flag.String("tls-pin", "", "Comma-separated sha256/base64 SPKI pins for a TLS upstream")
+	tlsCert := flag.String("tls-cert", "", "Client certificate for a TLS upstream, relative to the config directory")
+	tlsKey := flag.String("tls-key", "", "Client key for a TLS upstream, relative to the config directory")
+	sshKey := flag.String("ssh-key", "", "Private key file for an SSH upstream, stored with the encrypted credentials")
+	knownHosts := flag.String("known-hosts", "", "known_hosts file used to verify an SSH upstream (default: ~/.ssh/known_hosts)")
+	chain := flag.String("chain", "", "Additional upstream hops reached through the first one, as comma-separated [scheme://][user:pass@]host:port (\"none\" clears the chain)")
+	rules := flag.String("rules", "", "Semicolon-separated routing rules, such as \"direct domain=localhost net=10.0.0.0/8; reject port=25\" (\"none\" clears them)")
+	chains := flag.String("chains", "", "Semicolon-separated named chains for routing rules, as name=hops (\"none\" clears them)")
+	resolve := flag.String("resolve", "", "Where target host names are resolved: remote (by the upstream), local, or preserve (as the client sent them) (default remote)")
+	pacListen := flag.String("pac-listen", "", "Address to serve a proxy auto-config file on, such as 127.0.0.1:8081 (\"none\" disables it)")
+	dnsListen := flag.String("dns-listen", "", "Address to run a DNS server on, over UDP and TCP, such as 127.0.0.1:5353 (\"none\" disables it)")
+	dnsResolver := flag.String("dns-resolver", "", "Resolver the DNS server forwards queries to through the upstream chain, as host:port (default 1.1.1.1:53)")
+	forwards := flag.String("forwards", "", "Comma-separated static port forwards through the chain, as listen=target such as 127.0.0.1:5432=db.internal:5432 (\"none\" clears them)")
+	reverse := flag.String("reverse", "", "Comma-separated local host:port services to expose through a BIND on the last upstream hop (\"none\" clears them)")
+	transparentListen := flag.String("transparent-listen", "", "Address for connections redirected by iptables or nftables REDIRECT, which are sent through the chain to their original destination (Linux only, \"none\" disables it)")
+	tproxyListen := flag.String("tproxy-listen", "", "Address for TCP and UDP traffic diverted by TPROXY rules, which is sent through the chain to its original destination (Linux only, \"none\" disables it)")
 	localHost := flag.String("local-host", "127.0.0.1", "Local host to bind")
 	localPort := flag.Int("local-port", 1080, "Local port to bind")
+	listen := flag.String("listen", "", "Semicolon-separated listeners replacing --local-host and --local-port, as host:port or unix:path with options such as mode=0660 owner=user:group auth=none (\"none\" clears them)")
+	listenCert := flag.String("listen-cert", "", "Certificate for serving TLS on the local listener, relative to the config directory (\"none\" disables TLS)")
+	listenKey := flag.String("listen-key", "", "Key for serving TLS on the local listener, relative to the config directory")
+	proxyProtocol := flag.String("proxy-protocol", "", "Comma-separated addresses or CIDRs of load balancers whose connections start with a PROXY protocol header (\"none\" clears them)")
+	listenClientCA := flag.String("listen-client-ca", "", "PEM CA bundle that local clients' certificates must chain to (\"none\" disables mutual TLS)")
 	logFile := flag.String("log-file", "", "Log file location")
 	consoleLog := flag.Bool("console-log", false, "Enable console logging")
 	configureMode := flag.Bool("configure", false, "Interactive mode to configure credentials")
 	guiMode := flag.Bool("gui", false, "Launch graphical user interface for configuration")
+	addLocalUser := flag.String("add-local-user", "", "Add or update a user allowed to connect to the local listener")
+	removeLocalUser := flag.String("remove-local-user", "", "Remove a user allowed to connect to the local listener")
 	flag.Parse()
 
 	// Show version if requested
@@ -94,6 +142,22 @@ func main() {
 		return
 	}
 
+	// Manage local listener users if requested
+	if *addLocalUser != "" {
+		if err := setupLocalUser(*addLocalUser); err != nil {
+			log.Fatal("Error adding local user:", err)
+		}
+		fmt.Printf("Local user %q saved\n", *addLocalUser)
+		return
+	}
+	if *removeLocalUser != "" {
+		if err := config.RemoveLocalUser(*removeLocalUser); err != nil {
+			log.Fatal("Error removing local user:", err)
+		}
+		fmt.Printf("Local user %q removed\n", *removeLocalUser)
+		return
+	}
+
 	// Handle interactive configuration if requested
 	if *configureMode {
 		var err error
@@ -103,9 +167,206 @@ func main() {
 		}
 	}
 
+	// Settings without a LoadOrCreate parameter are applied before the
+	// configuration is validated and saved
+	applyFlags := func(cfg *config.Config) error {
+		if *upstreamType != "" {
+			hopType, useTLS, err := config.ParseHopType(*upstreamType)
+			if err != nil {
+				return err
+			}
+			cfg.UpstreamType, cfg.UpstreamTLS = hopType, useTLS
+		}
+		switch *upstreamEndpoints {
+		case "":
+		case "none":
+			cfg.Endpoints = nil
+		default:
+			endpoints, err := config.ParseEndpoints(*upstreamEndpoints)
+			if err != nil {
+				return err
+			}
+			cfg.Endpoints = endpoints
+		}
+		if *upstreamWeight > 0 {
+			cfg.UpstreamWeight = *upstreamWeight
+		}
+		if *balance != "" {
+			cfg.Balance = *balance
+		}
+		if *healthCheckInterval > 0 {
+			cfg.HealthCheckInterval = *healthCheckInterval
+		}
+		if *upstreamTLS {
+			cfg.UpstreamTLS = true
+		}
+		if *tlsServerName != "" || *tlsCA != "" || *tlsPins != "" || *tlsCert != "" || *tlsKey != "" {
+			opts := config.TLSOptions{}
+			if cfg.UpstreamTLSOptions != nil {
+				opts = *cfg.UpstreamTLSOptions
+			}
+			if *tlsServerName != "" {
+				opts.ServerName = *tlsServerName
+			}
+			if *tlsCA != "" {
+				opts.CAFile = *tlsCA
+			}
+			if *tlsPins != "" {
+				opts.Pins = strings.Split(*tlsPins, ",")
+			}
+			if *tlsCert != "" {
+				opts.CertFile = *tlsCert
+			}
+			if *tlsKey != "" {
+				opts.KeyFile = *tlsKey
+			}
+			cfg.UpstreamTLSOptions = &opts
+		}
+		if *listenCert == "none" {
+			cfg.ListenTLS = nil
+		} else if *listenCert != "" || *listenKey != "" || *listenClientCA != "" {
+			listenTLS := config.ListenTLS{}
+			if cfg.ListenTLS != nil {
+				listenTLS = *cfg.ListenTLS
+			}
+			if *listenCert != "" {
+				listenTLS.CertFile = *listenCert
+			}
+			if *listenKey != "" {
+				listenTLS.KeyFile = *listenKey
+			}
+			switch *listenClientCA {
+			case "":
+			case "none":
+				listenTLS.ClientCAFile = ""
+			default:
+				listenTLS.ClientCAFile = *listenClientCA
+			}
+			cfg.ListenTLS = &listenTLS
+		}
+		switch *proxyProtocol {
+		case "":
+		case "none":
+			cfg.ProxyProtocol = nil
+		default:
+			cfg.ProxyProtocol = strings.Split(*proxyProtocol, ",")
+		}
+		if *sshKey != "" {
+			key, err := os.ReadFile(*sshKey)
+			if err != nil {
+				return fmt.Errorf("failed to read SSH key: %v", err)
+			}
+			cfg.PrivateKey = string(key)
+		}
+		if *knownHosts != "" {
+			cfg.KnownHosts = *knownHosts
+		}
+		switch *chain {
+		case "":
+		case "none":
+			cfg.Chain = nil
+		default:
+			hops, err := config.ParseHops(*chain)
+			if err != nil {
+				return fmt.Errorf("invalid chain: %v", err)
+			}
+			cfg.Chain = hops
+		}
+		switch *chains {
+		case "":
+		case "none":
+			cfg.Chains = nil
+		default:
+			named, err := config.ParseChains(*chains)
+			if err != nil {
+				return err
+			}
+			cfg.Chains = named
+		}
+		if *resolve != "" {
+			cfg.Resolve = *resolve
+		}
+		switch *pacListen {
+		case "":
+		case "none":
+			cfg.PACListen = ""
+		default:
+			cfg.PACListen = *pacListen
+		}
+		switch *dnsListen {
+		case "":
+		case "none":
+			cfg.DNSListen = ""
+		default:
+			cfg.DNSListen = *dnsListen
+		}
+		if *dnsResolver != "" {
+			cfg.DNSResolver = *dnsResolver
+		}
+		switch *forwards {
+		case "":
+		case "none":
+			cfg.Forwards = nil
+		default:
+			parsed, err := config.ParseForwards(*forwards)
+			if err != nil {
+				return err
+			}
+			cfg.Forwards = parsed
+		}
+		switch *listen {
+		case "":
+		case "none":
+			cfg.Listeners = nil
+		default:
+			parsed, err := config.ParseListeners(*listen)
+			if err != nil {
+				return err
+			}
+			cfg.Listeners = parsed
+		}
+		switch *transparentListen {
+		case "":
+		case "none":
+			cfg.TransparentListen = ""
+		default:
+			cfg.TransparentListen = *transparentListen
+		}
+		switch *tproxyListen {
+		case "":
+		case "none":
+			cfg.TProxyListen = ""
+		default:
+			cfg.TProxyListen = *tproxyListen
+		}
+		switch *reverse {
+		case "":
+		case "none":
+			cfg.Reverse = nil
+		default:
+			targets, err := config.ParseReverse(*reverse)
+			if err != nil {
+				return err
+			}
+			cfg.Reverse = targets
+		}
+		switch *rules {
+		case "":
+		case "none":
+			cfg.Rules = nil
+		default:
+			parsed, err := config.ParseRules(*rules)
+			if err != nil {
+				return err
+			}
+			cfg.Rules = parsed
+		}
+		return nil
+	}
+
 	// Load or create configuration
 	var cfg *config.Config
-	cfg, err := config.LoadOrCreate(*username, *password, *encpass, *upstreamHost, *upstreamPort)
+	cfg, err := config.LoadOrCreateWith(*username, *password, *encpass, *upstreamHost, *upstreamPort, applyFlags)
 	if err == config.ErrEncryptionPasswordRequired {
 		// Prompt for encryption password
 		pwd, promptErr := readPassword("Enter encryption password to decrypt credentials: ")
@@ -113,7 +374,8 @@ func main() {
 			log.Fatal("Failed to read encryption password:", promptErr)
 		}
 		// Try loading again with the provided password
-		cfg, err = config.LoadOrCreate(*username, *password, pwd, *upstreamHost, *upstreamPort)
+		*encpass = pwd
+		cfg, err = config.LoadOrCreateWith(*username, *password, *encpass, *upstreamHost, *upstreamPort, applyFlags)
 	}
 	if err != nil {
 		log.Fatal("Error loading configuration:", err)
@@ -121,7 +383,10 @@ func main() {
 
 	// Create and start proxy server
 	server := proxy.NewServer(cfg)
-	localAddr := fmt.Sprintf("%s:%d", *localHost, *localPort)
+	localAddr := net.JoinHostPort(*localHost, strconv.Itoa(*localPort))
+	if len(cfg.Listeners) > 0 {
+		localAddr = ""
+	}
 
 	// Create error channel for server errors
 	errChan := make(chan error, 1)
@@ -131,7 +396,63 @@ func main() {
 		}
 	}()
 
-	log.Printf("SOCKS5 proxy server listening on %s", localAddr)
+	if localAddr != "" {
+		log.Printf("SOCKS5 proxy server listening on %s", localAddr)
+	}
+	for _, listener := range cfg.Listeners {
+		log.Printf("SOCKS5 proxy server listening on %s", listener.Address)
+	}
+	if cfg.ListenTLS != nil {
+		if cfg.ListenTLS.ClientCAFile != "" {
+			log.Printf("Serving TLS, client certificates required")
+		} else {
+			log.Printf("Serving TLS")
+		}
+	}
+	if len(cfg.Chain) > 0 {
+		log.Printf("Chaining through %d upstream hops", len(cfg.Hops()))
+	}
+	if len(cfg.Endpoints) > 0 {
+		strategy := cfg.Balance
+		if strategy == "" {
+			strategy = config.BalanceFailover
+		}
+		log.Printf("Balancing between %d upstream endpoints (%s)", len(cfg.UpstreamEndpoints()), strategy)
+	}
+	if len(cfg.Rules) > 0 {
+		log.Printf("Routing with %d rules", len(cfg.Rules))
+	}
+	if cfg.Resolve == config.ResolveLocal {
+		log.Printf("Resolving host names locally")
+	}
+	if cfg.PACListen != "" {
+		log.Printf("Serving proxy auto-config at http://%s/proxy.pac", cfg.PACListen)
+	}
+	if cfg.DNSListen != "" {
+		resolver := cfg.DNSResolver
+		if resolver == "" {
+			resolver = "1.1.1.1:53"
+		}
+		log.Printf("Serving DNS on %s, forwarding to %s", cfg.DNSListen, resolver)
+	}
+	for _, forward := range cfg.Forwards {
+		log.Printf("Forwarding %s to %s", forward.Listen, forward.Target)
+	}
+	if cfg.TransparentListen != "" {
+		log.Printf("Accepting redirected connections on %s", cfg.TransparentListen)
+	}
+	if cfg.TProxyListen != "" {
+		log.Printf("Accepting TPROXY traffic on %s", cfg.TProxyListen)
+	}
+	if len(cfg.Reverse) > 0 {
+		log.Printf("Exposing %d local services through reverse tunnels", len(cfg.Reverse))
+	}
+	if len(cfg.ProxyProtocol) > 0 {
+		log.Printf("Accepting PROXY protocol headers from %s", strings.Join(cfg.ProxyProtocol, ", "))
+	}
+	if cfg.LocalAuthRequired() {
+		log.Printf("Local authentication enabled for %d user(s)", len(cfg.LocalUsers))
+	}
 
 	// Handle graceful shutdown
 	sigChan := make(chan os.Signal, 1)
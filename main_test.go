@@ -97,6 +97,9 @@ type MockUpstreamServer struct {
 	acceptConn bool
 	authFail   bool
 	connectFail bool
+	// connectReply overrides the success reply to CONNECT, e.g. to use a
+	// different bound address type
+	connectReply []byte
 }
 
 func NewMockUpstreamServer() *MockUpstreamServer {
@@ -149,7 +152,7 @@ func (m *MockUpstreamServer) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
 	// Handle SOCKS5 handshake
-	header := make([]byte, 3)
+	header := make([]byte, 2)
 	if _, err := io.ReadFull(conn, header); err != nil {
 		return
 	}
@@ -158,6 +161,11 @@ func (m *MockUpstreamServer) handleConnection(conn net.Conn) {
 		return
 	}
 
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
 	// Respond with username/password auth required
 	conn.Write([]byte{0x05, 0x02})
 
@@ -188,7 +196,11 @@ func (m *MockUpstreamServer) handleConnection(conn net.Conn) {
 	}
 
 	// Send success response
-	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	if m.connectReply != nil {
+		conn.Write(m.connectReply)
+	} else {
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	}
 
 	// Echo data back and forth
 	buffer := make([]byte, 4096)
@@ -404,6 +416,139 @@ func TestIntegrationAuthFailure(t *testing.T) {
 	}
 }
 
+// readSOCKS5Reply reads a variable-length SOCKS5 reply and returns the
+// reply code and the raw bound address (ATYP, address and port)
+func readSOCKS5Reply(conn net.Conn) (byte, []byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, nil, err
+	}
+	var addrLen int
+	switch header[3] {
+	case 0x01:
+		addrLen = 4
+	case 0x04:
+		addrLen = 16
+	case 0x03:
+		lenByte := make([]byte, 1)
+		if _, err := io.ReadFull(conn, lenByte); err != nil {
+			return 0, nil, err
+		}
+		rest := make([]byte, int(lenByte[0])+2)
+		if _, err := io.ReadFull(conn, rest); err != nil {
+			return 0, nil, err
+		}
+		return header[1], append([]byte{0x03, lenByte[0]}, rest...), nil
+	default:
+		return 0, nil, fmt.Errorf("unknown address type %d", header[3])
+	}
+	rest := make([]byte, addrLen+2)
+	if _, err := io.ReadFull(conn, rest); err != nil {
+		return 0, nil, err
+	}
+	return header[1], append([]byte{header[3]}, rest...), nil
+}
+
+func TestIntegrationBoundAddressTypes(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	tests := []struct {
+		name  string
+		bound []byte // ATYP, BND.ADDR, BND.PORT as sent by the upstream
+	}{
+		{
+			name:  "IPv4",
+			bound: []byte{0x01, 203, 0, 113, 5, 0x04, 0x38},
+		},
+		{
+			name: "IPv6",
+			bound: []byte{
+				0x04,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0x05,
+				0x04, 0x38,
+			},
+		},
+		{
+			name:  "Domain",
+			bound: append(append([]byte{0x03, 0x10}, "gw.proxy.example"...), 0x04, 0x38),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockUpstream := NewMockUpstreamServer()
+			mockUpstream.connectReply = append([]byte{0x05, 0x00, 0x00}, tt.bound...)
+			if err := mockUpstream.Start("127.0.0.1:0"); err != nil {
+				t.Fatalf("Failed to start mock upstream: %v", err)
+			}
+			defer mockUpstream.Stop()
+
+			cfg := &config.Config{
+				Username:     "testuser",
+				Password:     "testpass",
+				UpstreamHost: "127.0.0.1",
+				UpstreamPort: mockUpstream.Addr().(*net.TCPAddr).Port,
+			}
+			server := proxy.NewServer(cfg)
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to create listener: %v", err)
+			}
+			localAddr := listener.Addr().String()
+			listener.Close()
+
+			go server.Start(localAddr)
+			time.Sleep(100 * time.Millisecond)
+			defer server.Stop()
+
+			conn, err := net.Dial("tcp", localAddr)
+			if err != nil {
+				t.Fatalf("Failed to connect to proxy: %v", err)
+			}
+			defer conn.Close()
+
+			conn.Write([]byte{0x05, 0x01, 0x00})
+			response := make([]byte, 2)
+			if _, err := io.ReadFull(conn, response); err != nil {
+				t.Fatalf("Failed to read handshake response: %v", err)
+			}
+
+			conn.Write([]byte{
+				0x05, 0x01, 0x00, 0x03,
+				0x0b,
+				'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm',
+				0x00, 0x50,
+			})
+
+			rep, bound, err := readSOCKS5Reply(conn)
+			if err != nil {
+				t.Fatalf("Failed to read CONNECT response: %v", err)
+			}
+			if rep != 0x00 {
+				t.Fatalf("CONNECT failed with status: %d", rep)
+			}
+			if !bytes.Equal(bound, tt.bound) {
+				t.Errorf("Bound address = %v, want %v", bound, tt.bound)
+			}
+
+			// The tunnel must start exactly after the reply
+			testData := []byte("Hello, world!")
+			conn.Write(testData)
+			receivedData := make([]byte, len(testData))
+			if _, err := io.ReadFull(conn, receivedData); err != nil {
+				t.Fatalf("Failed to read echoed data: %v", err)
+			}
+			if !bytes.Equal(testData, receivedData) {
+				t.Errorf("Data mismatch: sent %q, received %q", testData, receivedData)
+			}
+		})
+	}
+}
+
 // Test command line argument parsing by running the binary
 func TestCommandLineArguments(t *testing.T) {
 	if testing.Short() {
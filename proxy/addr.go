@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	// Address types
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// unspecifiedAddr is sent when there is no meaningful address
+const unspecifiedAddr = "0.0.0.0:0"
+
+// readAddr reads a SOCKS5 ATYP, address and port and returns it as host:port
+func readAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case atypIPv4:
+		ipv4 := make([]byte, 4)
+		if _, err := io.ReadFull(r, ipv4); err != nil {
+			return "", err
+		}
+		host = net.IP(ipv4).String()
+	case atypDomain:
+		lenByte := make([]byte, 1)
+		if _, err := io.ReadFull(r, lenByte); err != nil {
+			return "", err
+		}
+		domain := make([]byte, lenByte[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	case atypIPv6:
+		ipv6 := make([]byte, 16)
+		if _, err := io.ReadFull(r, ipv6); err != nil {
+			return "", err
+		}
+		host = net.IP(ipv6).String()
+	default:
+		return "", fmt.Errorf("unsupported address type: %d", atyp[0])
+	}
+
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(r, portBytes); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(portBytes)
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// encodeAddr encodes host:port as a SOCKS5 ATYP, address and port. IP
+// literals use the matching IP address type, anything else is sent as a
+// domain name.
+func encodeAddr(addr string) ([]byte, error) {
+	return encodeAddrAs(addr, false)
+}
+
+// encodeAddrAs is encodeAddr, except that with asDomain set the host is
+// sent as a domain name even if it is an IP literal
+func encodeAddrAs(addr string, asDomain bool) ([]byte, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+
+	var buf []byte
+	if ip := net.ParseIP(host); ip != nil && !asDomain {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append([]byte{atypIPv4}, ip4...)
+		} else {
+			buf = append([]byte{atypIPv6}, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain name too long: %d bytes", len(host))
+		}
+		buf = append([]byte{atypDomain, byte(len(host))}, host...)
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(portNum)), nil
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"go-socks5-chain/config"
+)
+
+const (
+	// Username/password sub-negotiation (RFC 1929)
+	userPassVersion = 0x01
+	authSuccess     = 0x00
+	authFailure     = 0x01
+)
+
+// authenticateClient runs the RFC 1929 username/password sub-negotiation
+// with a local client and checks the credentials against the local users.
+func (s *Server) authenticateClient(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != userPassVersion {
+		return fmt.Errorf("unsupported auth version: %d", header[0])
+	}
+
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return err
+	}
+
+	passLen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, passLen); err != nil {
+		return err
+	}
+	password := make([]byte, passLen[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+
+	if !s.config.VerifyLocalUser(string(username), string(password)) {
+		conn.Write([]byte{userPassVersion, authFailure})
+		return fmt.Errorf("authentication failed for user %q", username)
+	}
+
+	_, err := conn.Write([]byte{userPassVersion, authSuccess})
+	return err
+}
+
+// authenticateUpstream runs the RFC 1929 username/password sub-negotiation
+// with an upstream hop
+func authenticateUpstream(conn net.Conn, hop config.Hop) error {
+	if len(hop.Username) > 255 || len(hop.Password) > 255 {
+		return fmt.Errorf("upstream username and password must be at most 255 bytes")
+	}
+
+	auth := []byte{userPassVersion}
+	auth = append(auth, byte(len(hop.Username)))
+	auth = append(auth, hop.Username...)
+	auth = append(auth, byte(len(hop.Password)))
+	auth = append(auth, hop.Password...)
+	if _, err := conn.Write(auth); err != nil {
+		return err
+	}
+
+	// Read auth response
+	response := make([]byte, 2)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+	if response[0] != userPassVersion {
+		return fmt.Errorf("unexpected auth version from upstream: %d", response[0])
+	}
+	if response[1] != authSuccess {
+		return errUpstreamAuth
+	}
+	return nil
+}
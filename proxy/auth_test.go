@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bytes"
+	"testing"
+
+	"go-socks5-chain/config"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newAuthTestServer(t *testing.T) *Server {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt.GenerateFromPassword() error = %v", err)
+	}
+	return NewServer(&config.Config{
+		Username:     "testuser",
+		Password:     "testpass",
+		UpstreamHost: "proxy.example.com",
+		UpstreamPort: 1080,
+		LocalUsers:   map[string]string{"alice": string(hash)},
+	})
+}
+
+func userPassRequest(username, password string) []byte {
+	req := []byte{0x01, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	return append(req, password...)
+}
+
+func TestHandleInitialHandshakeWithLocalAuth(t *testing.T) {
+	server := newAuthTestServer(t)
+
+	tests := []struct {
+		name      string
+		input     []byte
+		wantError bool
+		expected  []byte
+	}{
+		{
+			name:      "Valid credentials",
+			input:     append([]byte{0x05, 0x02, 0x00, 0x02}, userPassRequest("alice", "secret")...),
+			wantError: false,
+			expected:  []byte{0x05, 0x02, 0x01, 0x00},
+		},
+		{
+			name:      "Wrong password",
+			input:     append([]byte{0x05, 0x01, 0x02}, userPassRequest("alice", "wrong")...),
+			wantError: true,
+			expected:  []byte{0x05, 0x02, 0x01, 0x01},
+		},
+		{
+			name:      "Unknown user",
+			input:     append([]byte{0x05, 0x01, 0x02}, userPassRequest("mallory", "secret")...),
+			wantError: true,
+			expected:  []byte{0x05, 0x02, 0x01, 0x01},
+		},
+		{
+			name:      "Client offers only no auth",
+			input:     []byte{0x05, 0x01, 0x00},
+			wantError: true,
+			expected:  []byte{0x05, 0xFF},
+		},
+		{
+			name:      "Bad sub-negotiation version",
+			input:     []byte{0x05, 0x01, 0x02, 0x05, 0x00, 0x00},
+			wantError: true,
+			expected:  []byte{0x05, 0x02},
+		},
+		{
+			name:      "Truncated credentials",
+			input:     []byte{0x05, 0x01, 0x02, 0x01, 0x05, 'a', 'l'},
+			wantError: true,
+			expected:  []byte{0x05, 0x02},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := NewMockConn()
+			conn.AddReadData(tt.input)
+
+			err := server.handleInitialHandshake(conn, &listener{})
+			if (err != nil) != tt.wantError {
+				t.Errorf("handleInitialHandshake() error = %v, wantError %v", err, tt.wantError)
+			}
+
+			written := conn.GetWrittenData()
+			if !bytes.Equal(written, tt.expected) {
+				t.Errorf("handleInitialHandshake() wrote %v, want %v", written, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHandleInitialHandshakeNoAcceptableMethod(t *testing.T) {
+	server := NewServer(&config.Config{})
+
+	conn := NewMockConn()
+	conn.AddReadData([]byte{0x05, 0x01, 0x02}) // Only username/password offered
+
+	if err := server.handleInitialHandshake(conn, &listener{}); err == nil {
+		t.Error("handleInitialHandshake() should fail when no acceptable method is offered")
+	}
+	if written := conn.GetWrittenData(); !bytes.Equal(written, []byte{0x05, 0xFF}) {
+		t.Errorf("handleInitialHandshake() wrote %v, want %v", written, []byte{0x05, 0xFF})
+	}
+}
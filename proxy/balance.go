@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"math"
+	"net"
+	"sort"
+	"time"
+
+	"go-socks5-chain/config"
+)
+
+// candidate is an available endpoint along with what the pool knows about it
+type candidate struct {
+	endpoint config.Endpoint
+	weight   int           // At least 1
+	active   int           // Connections currently open through the endpoint
+	latency  time.Duration // Duration of the last health check, 0 if unknown
+}
+
+// balancer decides the order in which the available endpoints are tried for
+// a new connection from source to target; either may be empty. order is
+// called with the pool's lock held, so balancers can keep state without
+// locking of their own.
+type balancer interface {
+	order(candidates []candidate, source net.Addr, target string) []candidate
+}
+
+// newBalancer returns the balancer for a config.BalanceStrategies name.
+// Unknown names fall back to failover.
+func newBalancer(name string) balancer {
+	switch name {
+	case config.BalanceRoundRobin:
+		return &roundRobinBalancer{current: make(map[string]int)}
+	case config.BalanceLeastConnections:
+		return leastConnectionsBalancer{}
+	case config.BalanceLowestLatency:
+		return lowestLatencyBalancer{}
+	case config.BalanceHashClient:
+		return hashBalancer{key: clientKey}
+	case config.BalanceHashTarget:
+		return hashBalancer{key: targetKey}
+	default:
+		return failoverBalancer{}
+	}
+}
+
+// failoverBalancer keeps the configured order
+type failoverBalancer struct{}
+
+func (failoverBalancer) order(candidates []candidate, _ net.Addr, _ string) []candidate {
+	return candidates
+}
+
+// roundRobinBalancer is a smooth weighted round-robin: every endpoint gains
+// its weight on each pick and the one that is furthest ahead goes first,
+// which spreads an endpoint's turns out instead of bunching them up
+type roundRobinBalancer struct {
+	current map[string]int
+}
+
+func (b *roundRobinBalancer) order(candidates []candidate, _ net.Addr, _ string) []candidate {
+	if len(candidates) == 0 {
+		return candidates
+	}
+	total, best := 0, 0
+	for i, c := range candidates {
+		addr := c.endpoint.Addr()
+		b.current[addr] += c.weight
+		total += c.weight
+		if b.current[addr] > b.current[candidates[best].endpoint.Addr()] {
+			best = i
+		}
+	}
+	b.current[candidates[best].endpoint.Addr()] -= total
+
+	// The rest stay in configured order as fallbacks
+	ordered := append([]candidate{candidates[best]}, candidates[:best]...)
+	return append(ordered, candidates[best+1:]...)
+}
+
+// leastConnectionsBalancer prefers endpoints with fewer active connections
+// per unit of weight. Ties keep the configured order.
+type leastConnectionsBalancer struct{}
+
+func (leastConnectionsBalancer) order(candidates []candidate, _ net.Addr, _ string) []candidate {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].active*candidates[j].weight < candidates[j].active*candidates[i].weight
+	})
+	return candidates
+}
+
+// lowestLatencyBalancer prefers the endpoints whose last health check was
+// fastest. Endpoints that haven't been checked yet go last.
+type lowestLatencyBalancer struct{}
+
+func (lowestLatencyBalancer) order(candidates []candidate, _ net.Addr, _ string) []candidate {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i].latency, candidates[j].latency
+		if a == 0 || b == 0 {
+			return b == 0 && a != 0
+		}
+		return a < b
+	})
+	return candidates
+}
+
+// hashBalancer orders endpoints by weighted rendezvous hashing of a key
+// taken from the connection. A key keeps mapping to the same endpoint while
+// it is available, and only the keys of an endpoint that goes away move.
+type hashBalancer struct {
+	key func(source net.Addr, target string) string
+}
+
+// clientKey is the client's IP address
+func clientKey(source net.Addr, _ string) string {
+	if source == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(source.String()); err == nil {
+		return host
+	}
+	return source.String()
+}
+
+// targetKey is the target's host name or address
+func targetKey(_ net.Addr, target string) string {
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		return host
+	}
+	return target
+}
+
+func (b hashBalancer) order(candidates []candidate, source net.Addr, target string) []candidate {
+	key := b.key(source, target)
+	scores := make(map[string]float64, len(candidates))
+	for _, c := range candidates {
+		scores[c.endpoint.Addr()] = rendezvousScore(key, c.endpoint.Addr(), c.weight)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return scores[candidates[i].endpoint.Addr()] > scores[candidates[j].endpoint.Addr()]
+	})
+	return candidates
+}
+
+// rendezvousScore is the weighted rendezvous hash of key on an endpoint.
+// The hash is mapped to (0, 1) so -weight/ln(h) gives every endpoint a
+// share of the keys proportional to its weight.
+func rendezvousScore(key, addr string, weight int) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(addr))
+	u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+	return -float64(weight) / math.Log(u)
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"go-socks5-chain/config"
+)
+
+func firstChoices(pool *upstreamPool, endpoints []config.Endpoint, strategy string, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[pool.order(endpoints, strategy, nil, "")[0].Host]++
+	}
+	return counts
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	a := config.Endpoint{Host: "a", Port: 1080, Weight: 3}
+	b := config.Endpoint{Host: "b", Port: 1080}
+	c := config.Endpoint{Host: "c", Port: 1080, Weight: 2}
+	endpoints := []config.Endpoint{a, b, c}
+	pool := newUpstreamPool()
+
+	counts := firstChoices(pool, endpoints, config.BalanceRoundRobin, 60)
+	if counts["a"] != 30 || counts["b"] != 10 || counts["c"] != 20 {
+		t.Errorf("First choices = %v, want a:30 b:10 c:20", counts)
+	}
+
+	// Every order still offers the other endpoints as fallbacks
+	if got := pool.order(endpoints, config.BalanceRoundRobin, nil, ""); len(got) != 3 {
+		t.Errorf("order() = %v, want all three endpoints", got)
+	}
+
+	// Endpoints backing off are skipped without losing their turn forever
+	pool.markFailure(a)
+	counts = firstChoices(pool, endpoints, config.BalanceRoundRobin, 30)
+	if counts["a"] != 0 || counts["b"] != 10 || counts["c"] != 20 {
+		t.Errorf("First choices with a backing off = %v, want b:10 c:20", counts)
+	}
+}
+
+func TestLeastConnectionsBalancer(t *testing.T) {
+	a := config.Endpoint{Host: "a", Port: 1080}
+	b := config.Endpoint{Host: "b", Port: 1080, Weight: 2}
+	endpoints := []config.Endpoint{a, b}
+	pool := newUpstreamPool()
+
+	order := func() string {
+		got := pool.order(endpoints, config.BalanceLeastConnections, nil, "")
+		return got[0].Host + got[1].Host
+	}
+
+	if got := order(); got != "ab" {
+		t.Errorf("order() with no connections = %s, want the configured order", got)
+	}
+	conn := pool.track(a, NewMockConn())
+	if got := order(); got != "ba" {
+		t.Errorf("order() with one connection on a = %s, want ba", got)
+	}
+	pool.track(b, NewMockConn())
+	pool.track(b, NewMockConn())
+	if got := order(); got != "ab" {
+		t.Errorf("order() with a:1 b:2 = %s, want ab as b has twice the weight", got)
+	}
+	pool.track(b, NewMockConn())
+	if got := order(); got != "ab" {
+		t.Errorf("order() with a:1 b:3 = %s, want ab", got)
+	}
+
+	// Closing releases the connection exactly once
+	conn.Close()
+	conn.Close()
+	pool.mu.Lock()
+	active := pool.state(a).active
+	pool.mu.Unlock()
+	if active != 0 {
+		t.Errorf("Active connections on a after Close() = %d, want 0", active)
+	}
+}
+
+func TestLowestLatencyBalancer(t *testing.T) {
+	a := config.Endpoint{Host: "a", Port: 1080}
+	b := config.Endpoint{Host: "b", Port: 1080}
+	c := config.Endpoint{Host: "c", Port: 1080}
+	endpoints := []config.Endpoint{a, b, c}
+	pool := newUpstreamPool()
+
+	pool.markLatency(b, 30*time.Millisecond)
+	pool.markLatency(c, 10*time.Millisecond)
+
+	want := []config.Endpoint{c, b, a}
+	if got := pool.order(endpoints, config.BalanceLowestLatency, nil, ""); !equalEndpoints(got, want) {
+		t.Errorf("order() = %v, want %v with the unchecked endpoint last", got, want)
+	}
+}
+
+func TestHashBalancer(t *testing.T) {
+	var endpoints []config.Endpoint
+	for i := 0; i < 4; i++ {
+		endpoints = append(endpoints, config.Endpoint{Host: fmt.Sprintf("10.0.0.%d", i+1), Port: 1080})
+	}
+	endpoints[3].Weight = 3
+	pool := newUpstreamPool()
+
+	pick := func(endpoints []config.Endpoint, strategy string, source net.Addr, target string) config.Endpoint {
+		return pool.order(endpoints, strategy, source, target)[0]
+	}
+
+	// The same client always lands on the same endpoint, whatever the port
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 40000}
+	first := pick(endpoints, config.BalanceHashClient, client, "example.com:443")
+	for port := 40001; port < 40010; port++ {
+		source := &net.TCPAddr{IP: client.IP, Port: port}
+		if got := pick(endpoints, config.BalanceHashClient, source, fmt.Sprintf("host%d.example.com:80", port)); got != first {
+			t.Fatalf("Client %v went to %v, want %v", source, got, first)
+		}
+	}
+
+	// The same target host always lands on the same endpoint, whatever the client
+	first = pick(endpoints, config.BalanceHashTarget, client, "example.com:443")
+	for port := 40001; port < 40010; port++ {
+		source := &net.TCPAddr{IP: net.IPv4(192, 0, 2, byte(port)), Port: port}
+		if got := pick(endpoints, config.BalanceHashTarget, source, "example.com:80"); got != first {
+			t.Fatalf("Target example.com from %v went to %v, want %v", source, got, first)
+		}
+	}
+
+	// Keys spread by weight, and removing an endpoint only moves its own keys
+	const keys = 6000
+	counts := make(map[config.Endpoint]int)
+	moved := 0
+	for i := 0; i < keys; i++ {
+		target := fmt.Sprintf("host%d.example.com:443", i)
+		got := pick(endpoints, config.BalanceHashTarget, nil, target)
+		counts[got]++
+		if after := pick(endpoints[1:], config.BalanceHashTarget, nil, target); after != got {
+			moved++
+			if got != endpoints[0] {
+				t.Fatalf("Target %s moved from %v to %v when %v was removed", target, got, after, endpoints[0])
+			}
+		}
+	}
+	if moved != counts[endpoints[0]] {
+		t.Errorf("%d targets moved, want the %d of the removed endpoint", moved, counts[endpoints[0]])
+	}
+	for i, endpoint := range endpoints {
+		want := keys / 6
+		if i == 3 {
+			want = keys / 2
+		}
+		if got := counts[endpoint]; got < want*8/10 || got > want*12/10 {
+			t.Errorf("Endpoint %v got %d of %d targets, want about %d", endpoint, got, keys, want)
+		}
+	}
+}
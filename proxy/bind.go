@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net"
+)
+
+// handleBind serves a BIND request by relaying it to the last upstream hop.
+// Both upstream replies are passed back to the client: the first carries the
+// address the upstream listens on, the second the address of the peer that
+// connected to it. After that the connection is spliced like a CONNECT.
+func (s *Server) handleBind(client net.Conn, target string) {
+	upstreamConn, err := s.connectToUpstream(client.RemoteAddr())
+	if err != nil {
+		log.Printf("Failed to connect to upstream: %v", err)
+		s.sendReply(client, replyCode(err), "")
+		return
+	}
+	defer upstreamConn.Close()
+
+	addr, err := encodeAddr(target)
+	if err != nil {
+		log.Printf("Invalid BIND address %q: %v", target, err)
+		s.sendReply(client, repGeneralFailure, "")
+		return
+	}
+	if _, err := upstreamConn.Write(append([]byte{VERSION, cmdBind, 0x00}, addr...)); err != nil {
+		log.Printf("Failed to forward BIND request: %v", err)
+		s.sendReply(client, repGeneralFailure, "")
+		return
+	}
+
+	// Waiting for the peer can take a while, so don't hold up shutdown
+	stop := context.AfterFunc(s.ctx, func() { upstreamConn.Close() })
+	defer stop()
+
+	// First reply: the address the upstream is listening on
+	rep, bound, err := readReply(upstreamConn)
+	if err != nil {
+		log.Printf("Failed to read BIND reply: %v", err)
+		s.sendReply(client, repGeneralFailure, "")
+		return
+	}
+	if err := s.sendReply(client, rep, bound); err != nil {
+		return
+	}
+	if rep != repSuccess {
+		log.Printf("Upstream BIND for %s failed: %d", target, rep)
+		return
+	}
+	log.Printf("Upstream bound %s for %s", bound, client.RemoteAddr())
+
+	// Second reply: the peer that connected
+	rep, peer, err := readReply(upstreamConn)
+	if err != nil {
+		log.Printf("Failed to read BIND peer reply: %v", err)
+		s.sendReply(client, repGeneralFailure, "")
+		return
+	}
+	if err := s.sendReply(client, rep, peer); err != nil {
+		return
+	}
+	if rep != repSuccess {
+		log.Printf("Upstream BIND for %s failed waiting for peer: %d", target, rep)
+		return
+	}
+	stop()
+
+	s.forwardTraffic(client, upstreamConn)
+}
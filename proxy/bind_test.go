@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go-socks5-chain/config"
+)
+
+// startBindUpstream starts a mock SOCKS5 upstream that serves BIND by
+// listening on loopback and splicing the first peer that connects
+func startBindUpstream(t *testing.T) net.Listener {
+	t.Helper()
+	return startNotifyingBindUpstream(t, nil)
+}
+
+// startNotifyingBindUpstream is startBindUpstream, but also sends every
+// address it binds on bound
+func startNotifyingBindUpstream(t *testing.T, bound chan<- string) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start BIND upstream: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleBindUpstream(conn, bound)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+func handleBindUpstream(conn net.Conn, boundAddrs chan<- string) {
+	defer conn.Close()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	io.ReadFull(conn, methods)
+	conn.Write([]byte{0x05, 0x02})
+
+	auth := make([]byte, 2)
+	io.ReadFull(conn, auth)
+	user := make([]byte, auth[1])
+	io.ReadFull(conn, user)
+	plen := make([]byte, 1)
+	io.ReadFull(conn, plen)
+	pass := make([]byte, plen[0])
+	io.ReadFull(conn, pass)
+	conn.Write([]byte{0x01, 0x00})
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	if _, err := readAddr(conn); err != nil || req[1] != 0x02 {
+		return
+	}
+
+	bindListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	defer bindListener.Close()
+	bound, _ := encodeAddr(bindListener.Addr().String())
+	conn.Write(append([]byte{0x05, 0x00, 0x00}, bound...))
+	if boundAddrs != nil {
+		boundAddrs <- bindListener.Addr().String()
+	}
+
+	peer, err := bindListener.Accept()
+	if err != nil {
+		return
+	}
+	defer peer.Close()
+	peerAddr, _ := encodeAddr(peer.RemoteAddr().String())
+	conn.Write(append([]byte{0x05, 0x00, 0x00}, peerAddr...))
+
+	go io.Copy(peer, conn)
+	io.Copy(conn, peer)
+}
+
+func TestBindIntegration(t *testing.T) {
+	upstream := startBindUpstream(t)
+
+	cfg := &config.Config{
+		Username:     "testuser",
+		Password:     "testpass",
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Addr().(*net.TCPAddr).Port,
+	}
+	server := NewServer(cfg)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	localAddr := listener.Addr().String()
+	listener.Close()
+
+	go server.Start(localAddr)
+	time.Sleep(100 * time.Millisecond)
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	response := make([]byte, 2)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatalf("Failed to read handshake response: %v", err)
+	}
+
+	// BIND, expecting a connection from 127.0.0.1
+	conn.Write([]byte{0x05, 0x02, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x15})
+
+	rep, bound, err := readReply(conn)
+	if err != nil {
+		t.Fatalf("Failed to read first BIND reply: %v", err)
+	}
+	if rep != 0x00 {
+		t.Fatalf("BIND failed with status: %d", rep)
+	}
+
+	// Connect as the peer the client is waiting for
+	peer, err := net.Dial("tcp", bound)
+	if err != nil {
+		t.Fatalf("Failed to connect to bound address %s: %v", bound, err)
+	}
+	defer peer.Close()
+
+	rep, peerAddr, err := readReply(conn)
+	if err != nil {
+		t.Fatalf("Failed to read second BIND reply: %v", err)
+	}
+	if rep != 0x00 {
+		t.Fatalf("BIND peer reply failed with status: %d", rep)
+	}
+	if peerAddr != peer.LocalAddr().String() {
+		t.Errorf("Peer address = %s, want %s", peerAddr, peer.LocalAddr())
+	}
+
+	// Traffic flows both ways once the peer is connected
+	peer.Write([]byte("from peer"))
+	buf := make([]byte, len("from peer"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Failed to read peer data: %v", err)
+	}
+	if !bytes.Equal(buf, []byte("from peer")) {
+		t.Errorf("Client received %q, want %q", buf, "from peer")
+	}
+
+	conn.Write([]byte("from client"))
+	buf = make([]byte, len("from client"))
+	if _, err := io.ReadFull(peer, buf); err != nil {
+		t.Fatalf("Failed to read client data: %v", err)
+	}
+	if !bytes.Equal(buf, []byte("from client")) {
+		t.Errorf("Peer received %q, want %q", buf, "from client")
+	}
+}
@@ -0,0 +1,382 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"go-socks5-chain/config"
+)
+
+// relayUpstream is a minimal SOCKS5 server that really connects to the
+// requested target, so several of them can be chained together. It requires
+// username/password authentication unless username is empty.
+type relayUpstream struct {
+	listener net.Listener
+	username string
+	password string
+
+	mu        sync.Mutex
+	targets   []string
+	addrTypes []byte
+}
+
+func startRelayUpstream(t *testing.T, username, password string) *relayUpstream {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start relay upstream: %v", err)
+	}
+	return serveRelayUpstream(t, listener, username, password)
+}
+
+// serveRelayUpstream runs a relayUpstream on an existing listener
+func serveRelayUpstream(t *testing.T, listener net.Listener, username, password string) *relayUpstream {
+	t.Helper()
+	r := &relayUpstream{listener: listener, username: username, password: password}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.handle(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return r
+}
+
+func (r *relayUpstream) hop() config.Hop {
+	addr := r.listener.Addr().(*net.TCPAddr)
+	return config.Hop{Host: "127.0.0.1", Port: addr.Port, Username: r.username, Password: r.password}
+}
+
+func (r *relayUpstream) requestedTargets() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.targets...)
+}
+
+// requestedAddrTypes returns the ATYP of every requested target
+func (r *relayUpstream) requestedAddrTypes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]byte(nil), r.addrTypes...)
+}
+
+func (r *relayUpstream) handle(conn net.Conn) {
+	defer conn.Close()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if r.username == "" {
+		// Open hop
+		if !bytes.Contains(methods, []byte{0x00}) {
+			conn.Write([]byte{0x05, 0xFF})
+			return
+		}
+		conn.Write([]byte{0x05, 0x00})
+	} else {
+		if !bytes.Contains(methods, []byte{0x02}) {
+			conn.Write([]byte{0x05, 0xFF})
+			return
+		}
+		conn.Write([]byte{0x05, 0x02})
+
+		// RFC 1929 sub-negotiation
+		ver := make([]byte, 2)
+		if _, err := io.ReadFull(conn, ver); err != nil {
+			return
+		}
+		user := make([]byte, ver[1])
+		io.ReadFull(conn, user)
+		plen := make([]byte, 1)
+		io.ReadFull(conn, plen)
+		pass := make([]byte, plen[0])
+		io.ReadFull(conn, pass)
+		if string(user) != r.username || string(pass) != r.password {
+			conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+
+	// CONNECT request
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 0x01:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 0x03:
+		l := make([]byte, 1)
+		io.ReadFull(conn, l)
+		name := make([]byte, l[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	case 0x04:
+		ip := make([]byte, 16)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBytes); err != nil {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portBytes))))
+
+	r.mu.Lock()
+	r.targets = append(r.targets, target)
+	r.addrTypes = append(r.addrTypes, req[3])
+	r.mu.Unlock()
+
+	remote, err := net.DialTimeout("tcp", target, time.Second)
+	if err != nil {
+		conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0}) // Connection refused
+		return
+	}
+	defer remote.Close()
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(remote, conn)
+	io.Copy(conn, remote)
+}
+
+// startEchoServer starts a TCP server that echoes everything back
+func startEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start echo server: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+func TestConnectToUpstreamMultiHop(t *testing.T) {
+	echo := startEchoServer(t)
+	first := startRelayUpstream(t, "user1", "pass1")
+	second := startRelayUpstream(t, "user2", "pass2")
+	third := startRelayUpstream(t, "user3", "pass3")
+
+	firstHop := first.hop()
+	cfg := &config.Config{
+		Username:     firstHop.Username,
+		Password:     firstHop.Password,
+		UpstreamHost: firstHop.Host,
+		UpstreamPort: firstHop.Port,
+		Chain:        []config.Hop{second.hop(), third.hop()},
+	}
+	server := NewServer(cfg)
+
+	conn, err := server.connectToUpstream(nil)
+	if err != nil {
+		t.Fatalf("connectToUpstream() error = %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := server.forwardRequest(conn, echo.Addr().String(), false); err != nil {
+		t.Fatalf("forwardRequest() error = %v", err)
+	}
+
+	testData := []byte("through three hops")
+	if _, err := conn.Write(testData); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	received := make([]byte, len(testData))
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if !bytes.Equal(received, testData) {
+		t.Errorf("Echoed data = %q, want %q", received, testData)
+	}
+
+	// Each hop must have been asked to connect to the next one
+	if got := first.requestedTargets(); len(got) != 1 || got[0] != second.hop().Addr() {
+		t.Errorf("First hop targets = %v, want [%s]", got, second.hop().Addr())
+	}
+	if got := second.requestedTargets(); len(got) != 1 || got[0] != third.hop().Addr() {
+		t.Errorf("Second hop targets = %v, want [%s]", got, third.hop().Addr())
+	}
+	if got := third.requestedTargets(); len(got) != 1 || got[0] != echo.Addr().String() {
+		t.Errorf("Third hop targets = %v, want [%s]", got, echo.Addr().String())
+	}
+}
+
+func TestConnectToUpstreamMultiHopAuthFailure(t *testing.T) {
+	first := startRelayUpstream(t, "user1", "pass1")
+	second := startRelayUpstream(t, "user2", "pass2")
+
+	badHop := second.hop()
+	badHop.Password = "wrong"
+
+	firstHop := first.hop()
+	cfg := &config.Config{
+		Username:     firstHop.Username,
+		Password:     firstHop.Password,
+		UpstreamHost: firstHop.Host,
+		UpstreamPort: firstHop.Port,
+		Chain:        []config.Hop{badHop},
+	}
+	server := NewServer(cfg)
+
+	conn, err := server.connectToUpstream(nil)
+	if err == nil {
+		conn.Close()
+		t.Fatal("connectToUpstream() should fail when a later hop rejects the credentials")
+	}
+}
+
+func TestConnectToUpstreamThroughOpenHop(t *testing.T) {
+	echo := startEchoServer(t)
+	first := startRelayUpstream(t, "user1", "pass1")
+	open := startRelayUpstream(t, "", "")
+
+	firstHop := first.hop()
+	cfg := &config.Config{
+		Username:     firstHop.Username,
+		Password:     firstHop.Password,
+		UpstreamHost: firstHop.Host,
+		UpstreamPort: firstHop.Port,
+		Chain:        []config.Hop{open.hop()},
+	}
+	server := NewServer(cfg)
+
+	conn, err := server.connectToUpstream(nil)
+	if err != nil {
+		t.Fatalf("connectToUpstream() error = %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := server.forwardRequest(conn, echo.Addr().String(), false); err != nil {
+		t.Fatalf("forwardRequest() error = %v", err)
+	}
+	conn.Write([]byte("ping"))
+	received := make([]byte, 4)
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if string(received) != "ping" {
+		t.Errorf("Echoed data = %q, want %q", received, "ping")
+	}
+}
+
+func TestUpstreamHandshake(t *testing.T) {
+	server := NewServer(&config.Config{})
+	withCreds := config.Hop{Host: "proxy.example.com", Port: 1080, Username: "user", Password: "pass"}
+	noCreds := config.Hop{Host: "proxy.example.com", Port: 1080}
+	authRequest := []byte{0x01, 0x04, 'u', 's', 'e', 'r', 0x04, 'p', 'a', 's', 's'}
+
+	tests := []struct {
+		name      string
+		hop       config.Hop
+		response  []byte
+		wantErr   error
+		wantError bool
+		wantSent  []byte
+	}{
+		{
+			name:     "No credentials, upstream needs none",
+			hop:      noCreds,
+			response: []byte{0x05, 0x00},
+			wantSent: []byte{0x05, 0x01, 0x00},
+		},
+		{
+			name:     "Credentials, upstream needs none",
+			hop:      withCreds,
+			response: []byte{0x05, 0x00},
+			wantSent: []byte{0x05, 0x02, 0x00, 0x02},
+		},
+		{
+			name:     "Credentials accepted",
+			hop:      withCreds,
+			response: []byte{0x05, 0x02, 0x01, 0x00},
+			wantSent: append([]byte{0x05, 0x02, 0x00, 0x02}, authRequest...),
+		},
+		{
+			name:     "Credentials rejected",
+			hop:      withCreds,
+			response: []byte{0x05, 0x02, 0x01, 0x01},
+			wantErr:  errUpstreamAuth,
+		},
+		{
+			name:     "No acceptable methods",
+			hop:      withCreds,
+			response: []byte{0x05, 0xFF},
+			wantErr:  errNoAcceptableMethods,
+		},
+		{
+			name:      "Upstream wants credentials we don't have",
+			hop:       noCreds,
+			response:  []byte{0x05, 0x02},
+			wantError: true,
+		},
+		{
+			name:      "Unsupported method selected",
+			hop:       withCreds,
+			response:  []byte{0x05, 0x01},
+			wantError: true,
+		},
+		{
+			name:      "Bad sub-negotiation version",
+			hop:       withCreds,
+			response:  []byte{0x05, 0x02, 0x05, 0x00},
+			wantError: true,
+		},
+		{
+			name:      "Bad greeting version",
+			hop:       withCreds,
+			response:  []byte{0x04, 0x00},
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := NewMockConn()
+			conn.AddReadData(tt.response)
+
+			err := server.upstreamHandshake(conn, tt.hop)
+			wantError := tt.wantError || tt.wantErr != nil
+			if (err != nil) != wantError {
+				t.Fatalf("upstreamHandshake() error = %v, wantError %v", err, wantError)
+			}
+			if tt.wantErr != nil && err != tt.wantErr {
+				t.Errorf("upstreamHandshake() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantSent != nil {
+				if written := conn.GetWrittenData(); !bytes.Equal(written, tt.wantSent) {
+					t.Errorf("upstreamHandshake() wrote %v, want %v", written, tt.wantSent)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,452 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// defaultDNSResolver is used when the config doesn't name one
+	defaultDNSResolver = "1.1.1.1:53"
+
+	// dnsTimeout bounds a single exchange with the resolver
+	dnsTimeout = 10 * time.Second
+
+	// dnsIdleTimeout closes TCP clients that stop sending queries
+	dnsIdleTimeout = 30 * time.Second
+
+	// dnsIdleConns is how many connections to the resolver are kept open
+	dnsIdleConns = 4
+
+	// dnsCacheSize bounds the number of cached answers
+	dnsCacheSize = 4096
+
+	// Without EDNS0, UDP answers are limited to 512 bytes
+	minDNSUDPSize = 512
+)
+
+// dnsServer answers DNS queries over UDP and TCP by forwarding them over
+// DNS-over-TCP to a resolver reached through the upstream chain
+type dnsServer struct {
+	server   *Server
+	resolver string
+	udp      net.PacketConn
+	tcp      net.Listener
+	cache    *dnsCache
+
+	// idle holds connections to the resolver for reuse
+	idle chan net.Conn
+}
+
+// startDNS serves DNS on addr, over both UDP and TCP, until the server stops
+func (s *Server) startDNS(addr string) error {
+	resolver := s.config.DNSResolver
+	if resolver == "" {
+		resolver = defaultDNSResolver
+	}
+	d := &dnsServer{
+		server:   s,
+		resolver: resolver,
+		cache:    newDNSCache(),
+		idle:     make(chan net.Conn, dnsIdleConns),
+	}
+
+	var err error
+	if d.udp, err = net.ListenPacket("udp", addr); err != nil {
+		return fmt.Errorf("failed to start DNS listener: %v", err)
+	}
+	if d.tcp, err = net.Listen("tcp", d.udp.LocalAddr().String()); err != nil {
+		d.udp.Close()
+		return fmt.Errorf("failed to start DNS listener: %v", err)
+	}
+	s.dns = d
+
+	go d.serveUDP()
+	go d.serveTCP()
+	return nil
+}
+
+// close stops the listeners and drops the idle resolver connections
+func (d *dnsServer) close() {
+	d.udp.Close()
+	d.tcp.Close()
+	for {
+		select {
+		case conn := <-d.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (d *dnsServer) serveUDP() {
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, from, err := d.udp.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := d.answer(query, true); resp != nil {
+				d.udp.WriteTo(resp, from)
+			}
+		}()
+	}
+}
+
+func (d *dnsServer) serveTCP() {
+	for {
+		conn, err := d.tcp.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go d.handleTCP(conn)
+	}
+}
+
+// handleTCP answers length-prefixed queries on conn until it goes idle
+func (d *dnsServer) handleTCP(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(dnsIdleTimeout))
+		query, err := readDNSMessage(conn)
+		if err != nil {
+			return
+		}
+		resp := d.answer(query, false)
+		if resp == nil {
+			return
+		}
+		if err := writeDNSMessage(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// answer returns the response to a query, from the cache or the resolver.
+// Queries that can't be parsed get no response. UDP responses that are too
+// large for the client are truncated, so it retries over TCP.
+func (d *dnsServer) answer(query []byte, udp bool) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || msg.Header.Response {
+		return nil
+	}
+
+	resp, err := d.resolve(&msg, query)
+	if err != nil {
+		log.Printf("DNS query for %s failed: %v", questionName(&msg), err)
+		resp, _ = replyWithCode(&msg, dnsmessage.RCodeServerFailure)
+		return resp
+	}
+	if udp && len(resp) > udpSizeLimit(&msg) {
+		resp, _ = truncated(&msg, resp)
+	}
+	return resp
+}
+
+// resolve answers msg, the parsed form of query, from the cache if possible
+func (d *dnsServer) resolve(msg *dnsmessage.Message, query []byte) ([]byte, error) {
+	key, cacheable := cacheKey(msg)
+	if cacheable {
+		if cached, ok := d.cache.get(key); ok {
+			cached.Header.ID = msg.Header.ID
+			if !hasOPT(msg) {
+				cached.Additionals = withoutOPT(cached.Additionals)
+			}
+			return cached.Pack()
+		}
+	}
+
+	resp, err := d.exchange(query)
+	if err != nil {
+		return nil, err
+	}
+	if cacheable {
+		var parsed dnsmessage.Message
+		if err := parsed.Unpack(resp); err == nil {
+			d.cache.put(key, parsed)
+		}
+	}
+	return resp, nil
+}
+
+// exchange sends query to the resolver over DNS-over-TCP and returns its
+// response. A reused connection may have been closed by the resolver in
+// the meantime, so a failure on one is retried on a new connection.
+func (d *dnsServer) exchange(query []byte) ([]byte, error) {
+	select {
+	case conn := <-d.idle:
+		if resp, err := d.roundTrip(conn, query); err == nil {
+			return resp, nil
+		}
+	default:
+	}
+
+	conn, _, err := d.server.dialTarget("", nil, d.resolver, false)
+	if err != nil {
+		return nil, err
+	}
+	return d.roundTrip(conn, query)
+}
+
+// roundTrip does one exchange on conn and keeps conn for reuse if it worked
+func (d *dnsServer) roundTrip(conn net.Conn, query []byte) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	err := writeDNSMessage(conn, query)
+	var resp []byte
+	if err == nil {
+		resp, err = readDNSMessage(conn)
+	}
+	if err == nil && (len(resp) < 2 || resp[0] != query[0] || resp[1] != query[1]) {
+		err = fmt.Errorf("response ID doesn't match the query")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	select {
+	case d.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return resp, nil
+}
+
+// readDNSMessage reads a DNS message with a two byte length prefix
+func readDNSMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeDNSMessage writes a DNS message with a two byte length prefix
+func writeDNSMessage(w io.Writer, msg []byte) error {
+	_, err := w.Write(binary.BigEndian.AppendUint16(nil, uint16(len(msg))))
+	if err == nil {
+		_, err = w.Write(msg)
+	}
+	return err
+}
+
+func questionName(msg *dnsmessage.Message) string {
+	if len(msg.Questions) == 0 {
+		return "(no question)"
+	}
+	return msg.Questions[0].Name.String()
+}
+
+// replyWithCode builds an empty response to msg with the given code
+func replyWithCode(msg *dnsmessage.Message, rcode dnsmessage.RCode) ([]byte, error) {
+	reply := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               msg.Header.ID,
+			Response:         true,
+			OpCode:           msg.Header.OpCode,
+			RecursionDesired: msg.Header.RecursionDesired,
+			RCode:            rcode,
+		},
+		Questions: msg.Questions,
+	}
+	return reply.Pack()
+}
+
+// truncated returns resp without its records and with the TC bit set
+func truncated(msg *dnsmessage.Message, resp []byte) ([]byte, error) {
+	var parsed dnsmessage.Message
+	if err := parsed.Unpack(resp); err != nil {
+		return replyWithCode(msg, dnsmessage.RCodeServerFailure)
+	}
+	parsed.Header.Truncated = true
+	parsed.Answers, parsed.Authorities, parsed.Additionals = nil, nil, nil
+	return parsed.Pack()
+}
+
+// udpSizeLimit returns the largest UDP response the client accepts
+func udpSizeLimit(msg *dnsmessage.Message) int {
+	for _, rr := range msg.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT && int(rr.Header.Class) > minDNSUDPSize {
+			return min(int(rr.Header.Class), maxUDPPacket)
+		}
+	}
+	return minDNSUDPSize
+}
+
+func hasOPT(msg *dnsmessage.Message) bool {
+	for _, rr := range msg.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutOPT(records []dnsmessage.Resource) []dnsmessage.Resource {
+	var kept []dnsmessage.Resource
+	for _, rr := range records {
+		if rr.Header.Type != dnsmessage.TypeOPT {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// dnsCacheKey identifies a cacheable query
+type dnsCacheKey struct {
+	name  string
+	typ   dnsmessage.Type
+	class dnsmessage.Class
+}
+
+// cacheKey returns the cache key for msg. Only standard queries with a
+// single question are cached.
+func cacheKey(msg *dnsmessage.Message) (dnsCacheKey, bool) {
+	if msg.Header.OpCode != 0 || len(msg.Questions) != 1 {
+		return dnsCacheKey{}, false
+	}
+	q := msg.Questions[0]
+	return dnsCacheKey{name: strings.ToLower(q.Name.String()), typ: q.Type, class: q.Class}, true
+}
+
+// dnsCacheEntry is a cached response and when it was stored
+type dnsCacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache keeps responses for as long as their TTLs allow
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[dnsCacheKey]*dnsCacheEntry
+	now     func() time.Time
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: make(map[dnsCacheKey]*dnsCacheEntry), now: time.Now}
+}
+
+// get returns a copy of the cached response for key with its TTLs reduced
+// by the time it has spent in the cache
+func (c *dnsCache) get(key dnsCacheKey) (dnsmessage.Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.entries[key]
+	now := c.now()
+	if entry == nil || !now.Before(entry.expires) {
+		delete(c.entries, key)
+		return dnsmessage.Message{}, false
+	}
+
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	msg := entry.msg
+	msg.Answers = agedRecords(msg.Answers, age)
+	msg.Authorities = agedRecords(msg.Authorities, age)
+	msg.Additionals = agedRecords(msg.Additionals, age)
+	return msg, true
+}
+
+// agedRecords copies records with age taken off their TTLs. The TTL field
+// of OPT records holds flags and is left alone.
+func agedRecords(records []dnsmessage.Resource, age uint32) []dnsmessage.Resource {
+	aged := make([]dnsmessage.Resource, len(records))
+	for i, rr := range records {
+		if rr.Header.Type != dnsmessage.TypeOPT {
+			rr.Header.TTL -= min(age, rr.Header.TTL)
+		}
+		aged[i] = rr
+	}
+	return aged
+}
+
+// put caches msg for its TTL. Only successful answers and negative answers
+// with an SOA record are cached.
+func (c *dnsCache) put(key dnsCacheKey, msg dnsmessage.Message) {
+	ttl, ok := cacheTTL(&msg)
+	if !ok || ttl == 0 || msg.Header.Truncated {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if len(c.entries) >= dnsCacheSize {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) >= dnsCacheSize {
+		// Still full of live entries: make room by dropping any one
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = &dnsCacheEntry{msg: msg, stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// cacheTTL returns how long msg may be cached: the lowest TTL of its
+// records or, for negative answers, the SOA's negative caching TTL as in
+// RFC 2308
+func cacheTTL(msg *dnsmessage.Message) (uint32, bool) {
+	switch msg.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+		if len(msg.Answers) == 0 {
+			return negativeTTL(msg)
+		}
+	case dnsmessage.RCodeNameError:
+		return negativeTTL(msg)
+	default:
+		return 0, false
+	}
+
+	ttl, found := uint32(0), false
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, rr := range section {
+			if rr.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if !found || rr.Header.TTL < ttl {
+				ttl, found = rr.Header.TTL, true
+			}
+		}
+	}
+	return ttl, found
+}
+
+func negativeTTL(msg *dnsmessage.Message) (uint32, bool) {
+	for _, rr := range msg.Authorities {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			return min(rr.Header.TTL, soa.MinTTL), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeResolver answers DNS-over-TCP queries with canned responses
+type fakeResolver struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	queries []string
+	answer  func(q dnsmessage.Question) dnsmessage.Message
+}
+
+func startFakeResolver(t *testing.T, answer func(q dnsmessage.Question) dnsmessage.Message) *fakeResolver {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start fake resolver: %v", err)
+	}
+	r := &fakeResolver{listener: listener, answer: answer}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.handle(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return r
+}
+
+func (r *fakeResolver) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		query, err := readDNSMessage(conn)
+		if err != nil {
+			return
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(query); err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.queries = append(r.queries, msg.Questions[0].Name.String())
+		r.mu.Unlock()
+
+		resp := r.answer(msg.Questions[0])
+		resp.Header.ID = msg.Header.ID
+		resp.Header.Response = true
+		resp.Questions = msg.Questions
+		packed, err := resp.Pack()
+		if err != nil {
+			return
+		}
+		if err := writeDNSMessage(conn, packed); err != nil {
+			return
+		}
+	}
+}
+
+func (r *fakeResolver) queryCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.queries)
+}
+
+// answerA answers every query with count A records with the given TTL, and
+// names under invalid. with NXDOMAIN
+func answerA(count int, ttl uint32) func(q dnsmessage.Question) dnsmessage.Message {
+	return func(q dnsmessage.Question) dnsmessage.Message {
+		if strings.HasSuffix(q.Name.String(), ".invalid.") {
+			return dnsmessage.Message{
+				Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+				Authorities: []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("invalid."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+					Body: &dnsmessage.SOAResource{
+						NS:     dnsmessage.MustNewName("ns.invalid."),
+						MBox:   dnsmessage.MustNewName("admin.invalid."),
+						MinTTL: 60,
+					},
+				}},
+			}
+		}
+		var msg dnsmessage.Message
+		for i := 0; i < count; i++ {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}},
+			})
+		}
+		return msg
+	}
+}
+
+// startDNSServer runs a DNS server that reaches resolver through a relay
+func startDNSServer(t *testing.T, resolver string) (*Server, *relayUpstream) {
+	t.Helper()
+	upstream := startRelayUpstream(t, "", "")
+	server := relayServer(upstream)
+	server.config.DNSResolver = resolver
+	if err := server.startDNS("127.0.0.1:0"); err != nil {
+		t.Fatalf("startDNS() error = %v", err)
+	}
+	t.Cleanup(server.dns.close)
+	return server, upstream
+}
+
+func packQuery(t *testing.T, id uint16, name string, edns uint16) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	if edns > 0 {
+		var opt dnsmessage.ResourceHeader
+		opt.SetEDNS0(int(edns), dnsmessage.RCodeSuccess, false)
+		msg.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("Packing query: %v", err)
+	}
+	return query
+}
+
+func exchangeUDP(t *testing.T, addr net.Addr, query []byte) dnsmessage.Message {
+	t.Helper()
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatalf("Dialing DNS server: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(query)
+	buf := make([]byte, maxUDPPacket)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Reading DNS response: %v", err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf[:n]); err != nil {
+		t.Fatalf("Unpacking DNS response: %v", err)
+	}
+	return msg
+}
+
+func TestDNSOverUDPAndTCP(t *testing.T) {
+	resolver := startFakeResolver(t, answerA(1, 300))
+	server, upstream := startDNSServer(t, resolver.listener.Addr().String())
+
+	resp := exchangeUDP(t, server.dns.udp.LocalAddr(), packQuery(t, 1, "example.com.", 0))
+	if resp.Header.ID != 1 || len(resp.Answers) != 1 {
+		t.Fatalf("UDP response = %+v, want ID 1 with one answer", resp)
+	}
+	if got := upstream.requestedTargets(); len(got) != 1 || got[0] != resolver.listener.Addr().String() {
+		t.Errorf("Upstream targets = %v, want the resolver", got)
+	}
+
+	conn, err := net.Dial("tcp", server.dns.tcp.Addr().String())
+	if err != nil {
+		t.Fatalf("Dialing DNS server: %v", err)
+	}
+	defer conn.Close()
+	for id := uint16(2); id < 4; id++ {
+		if err := writeDNSMessage(conn, packQuery(t, id, "example.org.", 0)); err != nil {
+			t.Fatalf("Writing query: %v", err)
+		}
+		packed, err := readDNSMessage(conn)
+		if err != nil {
+			t.Fatalf("Reading response: %v", err)
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(packed); err != nil || msg.Header.ID != id || len(msg.Answers) != 1 {
+			t.Fatalf("TCP response = %+v (%v), want ID %d with one answer", msg, err, id)
+		}
+	}
+
+	// The connection to the resolver is reused across queries
+	if got := len(upstream.requestedTargets()); got != 1 {
+		t.Errorf("Upstream got %d requests, want the resolver connection reused", got)
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	resolver := startFakeResolver(t, answerA(1, 300))
+	server, _ := startDNSServer(t, resolver.listener.Addr().String())
+	var clockMu sync.Mutex
+	now := time.Unix(1000000, 0)
+	server.dns.cache.mu.Lock()
+	server.dns.cache.now = func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		return now
+	}
+	server.dns.cache.mu.Unlock()
+	advance := func(d time.Duration) {
+		clockMu.Lock()
+		now = now.Add(d)
+		clockMu.Unlock()
+	}
+	addr := server.dns.udp.LocalAddr()
+
+	exchangeUDP(t, addr, packQuery(t, 1, "example.com.", 0))
+	advance(100 * time.Second)
+	resp := exchangeUDP(t, addr, packQuery(t, 2, "EXAMPLE.com.", 0))
+	if resp.Header.ID != 2 {
+		t.Errorf("Cached response ID = %d, want 2", resp.Header.ID)
+	}
+	if len(resp.Answers) != 1 || resp.Answers[0].Header.TTL != 200 {
+		t.Errorf("Cached answers = %+v, want one with TTL 200", resp.Answers)
+	}
+	if got := resolver.queryCount(); got != 1 {
+		t.Errorf("Resolver got %d queries, want the second answered from the cache", got)
+	}
+
+	advance(200 * time.Second)
+	exchangeUDP(t, addr, packQuery(t, 3, "example.com.", 0))
+	if got := resolver.queryCount(); got != 2 {
+		t.Errorf("Resolver got %d queries, want the expired answer fetched again", got)
+	}
+
+	// Negative answers are cached for the SOA's minimum TTL
+	for i := 0; i < 2; i++ {
+		resp = exchangeUDP(t, addr, packQuery(t, 4, "missing.invalid.", 0))
+		if resp.Header.RCode != dnsmessage.RCodeNameError {
+			t.Errorf("Response code = %v, want NXDOMAIN", resp.Header.RCode)
+		}
+	}
+	if got := resolver.queryCount(); got != 3 {
+		t.Errorf("Resolver got %d queries, want the NXDOMAIN answer cached", got)
+	}
+	advance(61 * time.Second)
+	exchangeUDP(t, addr, packQuery(t, 5, "missing.invalid.", 0))
+	if got := resolver.queryCount(); got != 4 {
+		t.Errorf("Resolver got %d queries, want the NXDOMAIN answer expired after 60s", got)
+	}
+}
+
+func TestDNSTruncation(t *testing.T) {
+	// 40 A records don't fit in 512 bytes
+	resolver := startFakeResolver(t, answerA(40, 300))
+	server, _ := startDNSServer(t, resolver.listener.Addr().String())
+	addr := server.dns.udp.LocalAddr()
+
+	resp := exchangeUDP(t, addr, packQuery(t, 1, "example.com.", 0))
+	if !resp.Header.Truncated || len(resp.Answers) != 0 || len(resp.Questions) != 1 {
+		t.Errorf("Response = %+v, want it truncated", resp)
+	}
+
+	resp = exchangeUDP(t, addr, packQuery(t, 2, "example.com.", 4096))
+	if resp.Header.Truncated || len(resp.Answers) != 40 {
+		t.Errorf("Response with EDNS0 = %d answers, truncated %v, want all 40", len(resp.Answers), resp.Header.Truncated)
+	}
+}
+
+func TestDNSResolverFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := listener.Addr().String()
+	listener.Close()
+	server, _ := startDNSServer(t, resolver)
+
+	resp := exchangeUDP(t, server.dns.udp.LocalAddr(), packQuery(t, 7, "example.com.", 0))
+	if resp.Header.ID != 7 || resp.Header.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("Response = %+v, want SERVFAIL with ID 7", resp.Header)
+	}
+}
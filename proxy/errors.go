@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// errUpstreamAuth is returned when an upstream hop rejects our credentials
+	errUpstreamAuth = errors.New("upstream authentication failed")
+
+	// errNoAcceptableMethods is returned when an upstream hop accepts none
+	// of the authentication methods we offered
+	errNoAcceptableMethods = errors.New("upstream accepted no offered authentication methods")
+
+	// errRejected is returned for connections a routing rule rejects
+	errRejected = errors.New("connection rejected by routing rule")
+)
+
+// replyError is a failure reply received from an upstream
+type replyError struct {
+	rep byte
+}
+
+func (e *replyError) Error() string {
+	return fmt.Sprintf("upstream connection failed: %d", e.rep)
+}
+
+// endpointError is a failure to reach or set up the first upstream hop,
+// which makes another endpoint of the primary upstream worth trying
+type endpointError struct {
+	err error
+}
+
+func (e *endpointError) Error() string { return e.err.Error() }
+func (e *endpointError) Unwrap() error { return e.err }
+
+// httpStatusError is a failure status received from an HTTP upstream
+type httpStatusError struct {
+	code int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("upstream HTTP proxy returned %d %s", e.code, http.StatusText(e.code))
+}
+
+// replyCode maps an error from dialing or talking to the upstream to the
+// SOCKS5 reply code reported to the client
+func replyCode(err error) byte {
+	var re *replyError
+	if errors.As(err, &re) {
+		if re.rep > repAddressNotSupported {
+			return repGeneralFailure
+		}
+		return re.rep
+	}
+	var he *httpStatusError
+	if errors.As(err, &he) {
+		switch he.code {
+		case http.StatusForbidden:
+			return repNotAllowed
+		case http.StatusGatewayTimeout, http.StatusRequestTimeout:
+			return repTTLExpired
+		case http.StatusBadGateway, http.StatusServiceUnavailable:
+			return repHostUnreachable
+		}
+		return repGeneralFailure
+	}
+
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		// An SSH hop refused or failed to open the channel
+		if openErr.Reason == ssh.Prohibited {
+			return repNotAllowed
+		}
+		return repHostUnreachable
+	}
+
+	var epErr *endpointError
+	switch {
+	case errors.Is(err, errUpstreamAuth), errors.Is(err, errNoAcceptableMethods):
+		// The upstream refused to let us through
+		return repNotAllowed
+	case errors.Is(err, errRejected):
+		return repNotAllowed
+	case errors.As(err, &epErr):
+		// The upstream itself is unreachable, which says nothing about
+		// the target, but a timeout is still reported as one
+		var netErr net.Error
+		if errors.As(epErr.err, &netErr) && netErr.Timeout() {
+			return repTTLExpired
+		}
+		return repGeneralFailure
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return repConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return repNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return repHostUnreachable
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return repTTLExpired
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return repHostUnreachable
+	}
+	return repGeneralFailure
+}
+
+// httpStatus maps an error from dialing or talking to the upstream to the
+// HTTP status reported to HTTP proxy clients
+func httpStatus(err error) int {
+	if errors.Is(err, errRejected) {
+		return http.StatusForbidden
+	}
+	if replyCode(err) == repTTLExpired {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
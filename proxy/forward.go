@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+)
+
+// startForwards listens on every static forward until the server stops
+func (s *Server) startForwards() error {
+	for _, forward := range s.config.Forwards {
+		listener, err := net.Listen("tcp", forward.Listen)
+		if err != nil {
+			return fmt.Errorf("failed to start forward %s: %v", forward, err)
+		}
+		s.forwards = append(s.forwards, listener)
+		go s.serveForward(listener, forward.Target)
+	}
+	return nil
+}
+
+func (s *Server) closeForwards() {
+	for _, listener := range s.forwards {
+		listener.Close()
+	}
+	s.forwards = nil
+}
+
+// serveForward accepts connections on listener and sends each through the
+// chain to target
+func (s *Server) serveForward(listener net.Listener, target string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Failed to accept forwarded connection: %v", err)
+			continue
+		}
+
+		s.wg.Add(1)
+		go s.handleForward(conn, target)
+	}
+}
+
+// handleForward relays a client of a static forward to its target. Routing
+// rules apply as they do to CONNECT requests.
+func (s *Server) handleForward(client net.Conn, target string) {
+	defer client.Close()
+	defer s.wg.Done()
+
+	upstreamConn, _, err := s.dialTarget("", client.RemoteAddr(), target, false)
+	if err != nil {
+		log.Printf("Failed to forward %s to %s: %v", client.RemoteAddr(), target, err)
+		return
+	}
+	defer upstreamConn.Close()
+
+	s.forwardTraffic(client, upstreamConn)
+}
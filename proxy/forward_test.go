@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"go-socks5-chain/config"
+)
+
+func TestStaticForward(t *testing.T) {
+	echo := startEchoServer(t)
+	upstream := startRelayUpstream(t, "user", "pass")
+	server := relayServer(upstream)
+	server.config.Forwards = []config.Forward{{Listen: "127.0.0.1:0", Target: echo.Addr().String()}}
+	if err := server.startForwards(); err != nil {
+		t.Fatalf("startForwards() error = %v", err)
+	}
+	defer server.closeForwards()
+
+	// Clients connect without any handshake, and each gets its own tunnel
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", server.forwards[0].Addr().String())
+		if err != nil {
+			t.Fatalf("Dialing forward: %v", err)
+		}
+		echoThrough(t, conn, "forwarded")
+		conn.Close()
+	}
+	if got := upstream.requestedTargets(); len(got) != 2 || got[0] != echo.Addr().String() {
+		t.Errorf("Upstream targets = %v, want the forward target twice", got)
+	}
+}
+
+func TestStaticForwardListenFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	server := NewServer(&config.Config{Forwards: []config.Forward{
+		{Listen: "127.0.0.1:0", Target: "db.internal:5432"},
+		{Listen: taken.Addr().String(), Target: "db.internal:5432"},
+	}})
+	if err := server.startServices(); err == nil {
+		t.Fatal("startServices() succeeded on a port in use")
+	}
+	server.closeServices()
+	if len(server.forwards) != 0 {
+		t.Errorf("%d forward listeners left open after a failed start", len(server.forwards))
+	}
+}
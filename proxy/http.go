@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// proxyAuthRealm is sent in Proxy-Authenticate challenges
+const proxyAuthRealm = "go-socks5-chain"
+
+// hopHeaders are connection-specific headers that are not forwarded to the
+// origin server
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// isHTTPMethodByte reports whether b can start an HTTP request line
+func isHTTPMethodByte(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+// handleHTTP serves an HTTP proxy client. CONNECT requests are tunneled and
+// absolute-URI requests are forwarded to the origin server, both through
+// the upstream chain. One request is served per connection.
+func (s *Server) handleHTTP(client *bufferedConn, l *listener) {
+	req, err := http.ReadRequest(client.r)
+	if err != nil {
+		log.Printf("HTTP request handling failed: %v", err)
+		writeHTTPError(client, http.StatusBadRequest)
+		return
+	}
+
+	if s.authRequired(l) {
+		username, password, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization"))
+		if !ok || !s.config.VerifyLocalUser(username, password) {
+			log.Printf("HTTP proxy authentication failed from %s", client.RemoteAddr())
+			writeHTTPError(client, http.StatusProxyAuthRequired)
+			return
+		}
+	}
+
+	if req.Method == http.MethodConnect {
+		s.handleHTTPConnect(client, req, l)
+		return
+	}
+	s.handleHTTPForward(client, req, l)
+}
+
+// handleHTTPConnect tunnels a CONNECT request through the upstream chain
+func (s *Server) handleHTTPConnect(client *bufferedConn, req *http.Request, l *listener) {
+	target := req.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		writeHTTPError(client, http.StatusBadRequest)
+		return
+	}
+
+	upstreamConn, _, err := s.dialTarget(l.id, client.RemoteAddr(), target, false)
+	if err != nil {
+		log.Printf("Failed to connect to %s through upstream: %v", target, err)
+		writeHTTPError(client, httpStatus(err))
+		return
+	}
+	defer upstreamConn.Close()
+
+	if _, err := fmt.Fprint(client, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+
+	// Anything the client sent after the request is still buffered in client
+	s.forwardTraffic(client, upstreamConn)
+}
+
+// handleHTTPForward forwards a plain HTTP request with an absolute URI to
+// the origin server and relays the response
+func (s *Server) handleHTTPForward(client *bufferedConn, req *http.Request, l *listener) {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		writeHTTPError(client, http.StatusBadRequest)
+		return
+	}
+
+	target := req.URL.Host
+	if req.URL.Port() == "" {
+		target = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+
+	upstreamConn, _, err := s.dialTarget(l.id, client.RemoteAddr(), target, false)
+	if err != nil {
+		log.Printf("Failed to connect to %s through upstream: %v", target, err)
+		writeHTTPError(client, httpStatus(err))
+		return
+	}
+	defer upstreamConn.Close()
+
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.Close = true
+	if err := req.Write(upstreamConn); err != nil {
+		log.Printf("Failed to forward HTTP request to %s: %v", target, err)
+		writeHTTPError(client, http.StatusBadGateway)
+		return
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(upstreamConn), req)
+	if err != nil {
+		log.Printf("Failed to read HTTP response from %s: %v", target, err)
+		writeHTTPError(client, http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	resp.Close = true
+	resp.Write(client)
+}
+
+// parseProxyAuth decodes a Basic Proxy-Authorization header value
+func parseProxyAuth(header string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok = strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", false
+	}
+	return username, password, true
+}
+
+// writeHTTPError writes an empty response with the given status; the
+// connection is closed afterwards
+func writeHTTPError(conn net.Conn, status int) {
+	extra := ""
+	if status == http.StatusProxyAuthRequired {
+		extra = fmt.Sprintf("Proxy-Authenticate: Basic realm=%q\r\n", proxyAuthRealm)
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n",
+		status, http.StatusText(status), extra)
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-socks5-chain/config"
+)
+
+// serveHTTPClient runs handleConnection on one end of a pipe and returns the
+// other end for the test to act as an HTTP proxy client
+func serveHTTPClient(t *testing.T, server *Server) net.Conn {
+	t.Helper()
+	client, proxyEnd := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	server.wg.Add(1)
+	go server.handleConnection(proxyEnd, &listener{})
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	return client
+}
+
+func relayServer(upstream *relayUpstream) *Server {
+	hop := upstream.hop()
+	return NewServer(&config.Config{
+		Username:     hop.Username,
+		Password:     hop.Password,
+		UpstreamHost: hop.Host,
+		UpstreamPort: hop.Port,
+	})
+}
+
+func TestHTTPConnect(t *testing.T) {
+	echo := startEchoServer(t)
+	upstream := startRelayUpstream(t, "user", "pass")
+	client := serveHTTPClient(t, relayServer(upstream))
+
+	target := echo.Addr().String()
+	fmt.Fprintf(client, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+
+	br := bufio.NewReader(client)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("Failed to read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+	}
+
+	msg := "hello through http connect"
+	if _, err := io.WriteString(client, msg); err != nil {
+		t.Fatalf("Failed to write tunnel data: %v", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(br, got); err != nil {
+		t.Fatalf("Failed to read tunnel data: %v", err)
+	}
+	if string(got) != msg {
+		t.Errorf("Echoed %q, want %q", got, msg)
+	}
+	if targets := upstream.requestedTargets(); len(targets) != 1 || targets[0] != target {
+		t.Errorf("Upstream was asked for %v, want [%s]", targets, target)
+	}
+}
+
+func TestHTTPForward(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("Proxy-Authorization leaked to origin")
+		}
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.RequestURI())
+	}))
+	defer origin.Close()
+
+	upstream := startRelayUpstream(t, "user", "pass")
+	client := serveHTTPClient(t, relayServer(upstream))
+
+	fmt.Fprintf(client, "GET %s/path?q=1 HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic eDp5\r\n\r\n",
+		origin.URL, origin.Listener.Addr())
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "GET /path?q=1" {
+		t.Errorf("Response = %d %q, want 200 %q", resp.StatusCode, body, "GET /path?q=1")
+	}
+}
+
+func TestHTTPErrors(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	echo := startEchoServer(t)
+	upstream := startRelayUpstream(t, "user", "pass")
+	target := echo.Addr().String()
+	connect := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	basic := func(user, pass string) string {
+		return "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass)) + "\r\n"
+	}
+
+	tests := []struct {
+		name       string
+		upstream   int
+		localAuth  bool
+		request    string
+		wantStatus int
+	}{
+		{
+			name:       "Upstream not listening",
+			upstream:   closedPort,
+			request:    connect + "\r\n",
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "Missing proxy credentials",
+			localAuth:  true,
+			request:    connect + "\r\n",
+			wantStatus: http.StatusProxyAuthRequired,
+		},
+		{
+			name:       "Wrong proxy credentials",
+			localAuth:  true,
+			request:    connect + basic("alice", "wrong") + "\r\n",
+			wantStatus: http.StatusProxyAuthRequired,
+		},
+		{
+			name:       "Valid proxy credentials",
+			localAuth:  true,
+			request:    connect + basic("alice", "secret") + "\r\n",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Relative URI",
+			request:    "GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "CONNECT without port",
+			request:    "CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := relayServer(upstream)
+			if tt.localAuth {
+				server = newAuthTestServer(t)
+				hop := upstream.hop()
+				server.config.UpstreamHost, server.config.UpstreamPort = hop.Host, hop.Port
+				server.config.Username, server.config.Password = hop.Username, hop.Password
+			}
+			if tt.upstream != 0 {
+				server.config.UpstreamPort = tt.upstream
+			}
+			client := serveHTTPClient(t, server)
+
+			io.WriteString(client, tt.request)
+			resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("Status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") == "" {
+				t.Errorf("407 response without Proxy-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestParseProxyAuth(t *testing.T) {
+	tests := []struct {
+		header   string
+		wantUser string
+		wantPass string
+		wantOK   bool
+	}{
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("alice:se:cret")), "alice", "se:cret", true},
+		{"basic " + base64.StdEncoding.EncodeToString([]byte("bob:pw")), "bob", "pw", true},
+		{"Bearer token", "", "", false},
+		{"Basic !!!", "", "", false},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("nocolon")), "", "", false},
+		{"", "", "", false},
+	}
+
+	for _, tt := range tests {
+		user, pass, ok := parseProxyAuth(tt.header)
+		if user != tt.wantUser || pass != tt.wantPass || ok != tt.wantOK {
+			t.Errorf("parseProxyAuth(%q) = %q, %q, %v, want %q, %q, %v",
+				tt.header, user, pass, ok, tt.wantUser, tt.wantPass, tt.wantOK)
+		}
+	}
+}
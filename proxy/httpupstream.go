@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"go-socks5-chain/config"
+)
+
+// maxHTTPHeader bounds the size of a CONNECT response header from an HTTP hop
+const maxHTTPHeader = 64 << 10
+
+// httpConnect asks an HTTP proxy hop to open a CONNECT tunnel to target,
+// sending Basic credentials if the hop has them
+func httpConnect(conn net.Conn, hop config.Hop, target string) error {
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if hop.Username != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(hop.Username + ":" + hop.Password))
+		req += "Proxy-Authorization: Basic " + creds + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return err
+	}
+
+	header, err := readHTTPHeader(conn)
+	if err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(header)), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return fmt.Errorf("invalid response from HTTP upstream: %w", err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return errUpstreamAuth
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return &httpStatusError{code: resp.StatusCode}
+	}
+	return nil
+}
+
+// readHTTPHeader reads a response header up to and including the blank line.
+// It reads one byte at a time so that anything the target sends once the
+// tunnel is up is left unread on conn.
+func readHTTPHeader(r io.Reader) ([]byte, error) {
+	var header []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(header, []byte("\r\n\r\n")) {
+		if len(header) >= maxHTTPHeader {
+			return nil, fmt.Errorf("HTTP upstream response header too large")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		header = append(header, b[0])
+	}
+	return header, nil
+}
@@ -0,0 +1,287 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"go-socks5-chain/config"
+)
+
+// httpUpstream is a minimal HTTP CONNECT proxy that really connects to the
+// requested target. It requires Basic credentials unless username is empty,
+// and answers every CONNECT with status when status is non-zero.
+type httpUpstream struct {
+	listener net.Listener
+	username string
+	password string
+	status   int
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func startHTTPUpstream(t *testing.T, username, password string, status int) *httpUpstream {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start HTTP upstream: %v", err)
+	}
+	u := &httpUpstream{listener: listener, username: username, password: password, status: status}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go u.handle(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return u
+}
+
+func (u *httpUpstream) hop() config.Hop {
+	addr := u.listener.Addr().(*net.TCPAddr)
+	return config.Hop{
+		Host:     "127.0.0.1",
+		Port:     addr.Port,
+		Username: u.username,
+		Password: u.password,
+		Type:     config.HopTypeHTTP,
+	}
+}
+
+func (u *httpUpstream) requestedTargets() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.targets...)
+}
+
+func (u *httpUpstream) handle(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	u.mu.Lock()
+	u.targets = append(u.targets, req.Host)
+	u.mu.Unlock()
+
+	if u.username != "" {
+		user, pass, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization"))
+		if !ok || user != u.username || pass != u.password {
+			fmt.Fprint(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+	}
+	if u.status != 0 {
+		fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", u.status, http.StatusText(u.status))
+		return
+	}
+
+	target, err := net.DialTimeout("tcp", req.Host, 2*time.Second)
+	if err != nil {
+		fmt.Fprint(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	defer target.Close()
+	fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+	go io.Copy(target, br)
+	io.Copy(conn, target)
+}
+
+func TestConnectThroughHTTPUpstream(t *testing.T) {
+	echo := startEchoServer(t)
+	httpHop := startHTTPUpstream(t, "corp", "corppass", 0)
+	socksHop := startRelayUpstream(t, "user", "pass")
+
+	tests := []struct {
+		name  string
+		chain []config.Hop
+	}{
+		{name: "HTTP upstream only"},
+		{name: "HTTP proxy then SOCKS5 hop", chain: []config.Hop{socksHop.hop()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hop := httpHop.hop()
+			server := NewServer(&config.Config{
+				Username:     hop.Username,
+				Password:     hop.Password,
+				UpstreamHost: hop.Host,
+				UpstreamPort: hop.Port,
+				UpstreamType: config.HopTypeHTTP,
+				Chain:        tt.chain,
+			})
+
+			conn, bound, err := server.dialTarget("", nil, echo.Addr().String(), false)
+			if err != nil {
+				t.Fatalf("dialTarget() error = %v", err)
+			}
+			defer conn.Close()
+			if len(tt.chain) == 0 && bound != "" {
+				t.Errorf("dialTarget() bound = %q, want none from an HTTP upstream", bound)
+			}
+
+			msg := []byte("hello through the corporate proxy")
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			if _, err := conn.Write(msg); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Errorf("Echoed %q, want %q", got, msg)
+			}
+		})
+	}
+
+	targets := httpHop.requestedTargets()
+	if len(targets) != 2 || targets[0] != echo.Addr().String() || targets[1] != socksHop.hop().Addr() {
+		t.Errorf("HTTP upstream was asked for %v, want the echo server then the SOCKS5 hop", targets)
+	}
+}
+
+func TestHTTPUpstreamFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream *httpUpstream
+		password string
+		wantRep  byte
+	}{
+		{
+			name:     "Wrong credentials",
+			upstream: startHTTPUpstream(t, "corp", "corppass", 0),
+			password: "wrong",
+			wantRep:  repNotAllowed,
+		},
+		{
+			name:     "Forbidden",
+			upstream: startHTTPUpstream(t, "", "", http.StatusForbidden),
+			wantRep:  repNotAllowed,
+		},
+		{
+			name:     "Gateway timeout",
+			upstream: startHTTPUpstream(t, "", "", http.StatusGatewayTimeout),
+			wantRep:  repTTLExpired,
+		},
+		{
+			name:     "Bad gateway",
+			upstream: startHTTPUpstream(t, "", "", http.StatusBadGateway),
+			wantRep:  repHostUnreachable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hop := tt.upstream.hop()
+			if tt.password != "" {
+				hop.Password = tt.password
+			}
+			conn, err := net.Dial("tcp", hop.Addr())
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			defer conn.Close()
+
+			err = httpConnect(conn, hop, "example.com:443")
+			if err == nil {
+				t.Fatal("httpConnect() succeeded, want an error")
+			}
+			if got := replyCode(err); got != tt.wantRep {
+				t.Errorf("replyCode(%v) = %d, want %d", err, got, tt.wantRep)
+			}
+		})
+	}
+}
+
+func TestHTTPUpstreamRejectsBind(t *testing.T) {
+	hop := startHTTPUpstream(t, "", "", 0).hop()
+	server := NewServer(&config.Config{
+		UpstreamHost: hop.Host,
+		UpstreamPort: hop.Port,
+		UpstreamType: config.HopTypeHTTP,
+	})
+
+	client, proxyEnd := net.Pipe()
+	defer client.Close()
+	server.wg.Add(1)
+	go server.handleConnection(proxyEnd, &listener{})
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	client.Write([]byte{0x05, 0x01, 0x00})
+	io.ReadFull(client, make([]byte, 2))
+	client.Write([]byte{0x05, cmdBind, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+	rep, _, err := readReply(client)
+	if err != nil {
+		t.Fatalf("readReply() error = %v", err)
+	}
+	if rep != repCommandNotSupported {
+		t.Errorf("BIND through an HTTP upstream replied %d, want %d", rep, repCommandNotSupported)
+	}
+}
+
+func TestReadHTTPHeader(t *testing.T) {
+	r := bytes.NewReader([]byte("HTTP/1.1 200 OK\r\nX-Test: 1\r\n\r\nSSH-2.0-banner"))
+	header, err := readHTTPHeader(r)
+	if err != nil {
+		t.Fatalf("readHTTPHeader() error = %v", err)
+	}
+	if string(header) != "HTTP/1.1 200 OK\r\nX-Test: 1\r\n\r\n" {
+		t.Errorf("readHTTPHeader() = %q", header)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "SSH-2.0-banner" {
+		t.Errorf("Data after the header = %q, want it left unread", rest)
+	}
+
+	huge := bytes.Repeat([]byte("X"), maxHTTPHeader+1)
+	if _, err := readHTTPHeader(bytes.NewReader(huge)); err == nil {
+		t.Error("readHTTPHeader() accepted an oversized header")
+	}
+	if _, err := readHTTPHeader(bytes.NewReader([]byte("HTTP/1.1 200 OK\r\n"))); !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		t.Errorf("readHTTPHeader() on a truncated header error = %v, want EOF", err)
+	}
+}
+
+func TestHTTPConnectSendsCredentials(t *testing.T) {
+	client, upstream := net.Pipe()
+	defer client.Close()
+	defer upstream.Close()
+
+	hop := config.Hop{Host: "proxy", Port: 3128, Username: "corp", Password: "p@ss", Type: config.HopTypeHTTP}
+	done := make(chan error, 1)
+	go func() { done <- httpConnect(client, hop, "[2001:db8::1]:443") }()
+
+	req, err := http.ReadRequest(bufio.NewReader(upstream))
+	if err != nil {
+		t.Fatalf("ReadRequest() error = %v", err)
+	}
+	if req.Method != http.MethodConnect || req.Host != "[2001:db8::1]:443" {
+		t.Errorf("Request = %s %s, want CONNECT [2001:db8::1]:443", req.Method, req.Host)
+	}
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("corp:p@ss"))
+	if got := req.Header.Get("Proxy-Authorization"); got != want {
+		t.Errorf("Proxy-Authorization = %q, want %q", got, want)
+	}
+	fmt.Fprint(upstream, "HTTP/1.1 200 OK\r\n\r\n")
+	if err := <-done; err != nil {
+		t.Errorf("httpConnect() error = %v", err)
+	}
+}
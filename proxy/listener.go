@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go-socks5-chain/config"
+)
+
+// listener is one of the addresses the proxy accepts clients on
+type listener struct {
+	net.Listener
+	id     string // Identifies the listener to routing rules
+	noAuth bool   // Clients don't have to authenticate
+}
+
+// unixListener is a Unix domain socket that was moved into place after
+// binding, which net.UnixListener can't remove on close by itself
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// listen opens the socket of spec. A Unix domain socket left behind by an
+// earlier run is replaced, and the new one gets the configured mode and
+// owner before anyone can connect: it is bound in a private directory and
+// renamed into place once they are set.
+func listen(spec config.Listener) (*listener, error) {
+	if spec.Network() != "unix" {
+		l, err := net.Listen("tcp", spec.Address)
+		if err != nil {
+			return nil, err
+		}
+		return &listener{Listener: l, id: spec.ID(), noAuth: spec.NoAuth}, nil
+	}
+
+	path := spec.Path()
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".listen-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, filepath.Base(path))
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: private, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+	if err := setSocketOwnership(private, spec); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(private, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &listener{Listener: &unixListener{UnixListener: l, path: path}, id: spec.ID(), noAuth: spec.NoAuth}, nil
+}
+
+// removeStaleSocket removes the socket at path unless something still
+// accepts connections on it
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	if conn, err := net.DialTimeout("unix", path, dialTimeout); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+func setSocketOwnership(path string, spec config.Listener) error {
+	mode, err := spec.FileMode()
+	if err != nil {
+		return err
+	}
+	if spec.Mode != "" {
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			return err
+		}
+	}
+	if spec.Owner != "" {
+		uid, gid, err := lookupOwner(spec.Owner)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupOwner resolves "user" or "user:group", by name or numeric ID. The
+// group is -1, leaving it unchanged, when owner has none.
+func lookupOwner(owner string) (int, int, error) {
+	userName, groupName, _ := strings.Cut(owner, ":")
+	uid, err := strconv.Atoi(userName)
+	if err != nil {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return 0, 0, err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, fmt.Errorf("user %s has no numeric ID", userName)
+		}
+	}
+	if groupName == "" {
+		return uid, -1, nil
+	}
+	gid, err := strconv.Atoi(groupName)
+	if err != nil {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return 0, 0, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, fmt.Errorf("group %s has no numeric ID", groupName)
+		}
+	}
+	return uid, gid, nil
+}
+
+// serve accepts clients on l until it is closed
+func (s *Server) serve(l *listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Failed to accept connection on %s: %v", l.Addr(), err)
+			continue
+		}
+
+		s.wg.Add(1)
+		go s.handleConnection(conn, l)
+	}
+}
+
+// authRequired reports whether clients of l have to authenticate
+func (s *Server) authRequired(l *listener) bool {
+	return s.config.LocalAuthRequired() && !l.noAuth
+}
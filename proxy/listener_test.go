@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"go-socks5-chain/config"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// freeAddr returns a local address on network nothing listens on
+func freeAddr(t *testing.T, network, addr string) string {
+	t.Helper()
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Skipf("Can't listen on %s: %v", addr, err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// socks5Connect sends an unauthenticated CONNECT for target over conn and
+// returns the reply code, or methodNoAcceptable if no-auth was refused
+func socks5Connect(t *testing.T, conn net.Conn, target string) byte {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte{VERSION, 0x01, methodNoAuth})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		t.Fatalf("Reading method selection: %v", err)
+	}
+	if method[1] != methodNoAuth {
+		return method[1]
+	}
+	addr, _ := encodeAddr(target)
+	conn.Write(append([]byte{VERSION, cmdConnect, 0x00}, addr...))
+	rep, _, err := readReply(conn)
+	if err != nil {
+		t.Fatalf("readReply() error = %v", err)
+	}
+	return rep
+}
+
+func TestMultipleListeners(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix domain socket permissions are not supported on Windows")
+	}
+	upstream := startRelayUpstream(t, "user", "pass")
+	echo := startEchoServer(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt.GenerateFromPassword() error = %v", err)
+	}
+
+	public := freeAddr(t, "tcp", "127.0.0.1:0")
+	lan := freeAddr(t, "tcp", "127.0.0.1:0")
+	ipv6 := freeAddr(t, "tcp6", "[::1]:0")
+	socket := filepath.Join(t.TempDir(), "proxy.sock")
+
+	server := relayServer(upstream)
+	server.config.LocalUsers = map[string]string{"alice": string(hash)}
+	server.config.Listeners = []config.Listener{
+		{Address: lan, Name: "lan", NoAuth: true},
+		{Address: ipv6, NoAuth: true},
+		{Address: "unix:" + socket, Mode: "0600", NoAuth: true},
+	}
+	server.config.Rules = []config.Rule{{Listeners: []string{"lan"}, Action: config.RouteReject}}
+
+	done := make(chan error, 1)
+	go func() { done <- server.Start(public) }()
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		name    string
+		network string
+		addr    string
+		want    byte
+	}{
+		{"Local users apply by default", "tcp", public, methodNoAcceptable},
+		{"Rules can match the listener", "tcp", lan, repNotAllowed},
+		{"IPv6", "tcp", ipv6, repSuccess},
+		{"Unix domain socket", "unix", socket, repSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial(tt.network, tt.addr)
+			if err != nil {
+				t.Fatalf("Failed to connect to %s: %v", tt.addr, err)
+			}
+			defer conn.Close()
+			if rep := socks5Connect(t, conn, echo.Addr().String()); rep != tt.want {
+				t.Fatalf("Reply = %d, want %d", rep, tt.want)
+			}
+			if tt.want == repSuccess {
+				echoThrough(t, conn, "hello")
+			}
+		})
+	}
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("Socket mode = %o, want 600", perm)
+	}
+
+	server.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Start() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Start() did not return after Stop()")
+	}
+	for _, addr := range []string{public, lan, ipv6} {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Errorf("%s still accepts connections after Stop()", addr)
+		}
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Socket still exists after Stop(): %v", err)
+	}
+}
+
+func TestListenReplacesStaleSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix domain sockets are not removed the same way on Windows")
+	}
+	socket := filepath.Join(t.TempDir(), "proxy.sock")
+	spec := config.Listener{Address: "unix:" + socket}
+
+	l, err := listen(spec)
+	if err != nil {
+		t.Fatalf("listen() error = %v", err)
+	}
+	if _, err := listen(spec); err == nil {
+		t.Error("listen() took over a socket in use")
+	}
+
+	// Leave the socket file behind, as a crashed process would
+	l.Listener.(*unixListener).UnixListener.Close()
+	l, err = listen(spec)
+	if err != nil {
+		t.Fatalf("listen() on a stale socket error = %v", err)
+	}
+	l.Close()
+}
+
+func TestUDPAssociateOnUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix domain sockets are not supported on Windows")
+	}
+	upstream := startUDPUpstream(t)
+	socket := filepath.Join(t.TempDir(), "proxy.sock")
+	server := NewServer(&config.Config{
+		Username:     "testuser",
+		Password:     "testpass",
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.listener.Addr().(*net.TCPAddr).Port,
+		Listeners:    []config.Listener{{Address: "unix:" + socket}},
+	})
+	go server.Start("")
+	defer server.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to connect to %s: %v", socket, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte{VERSION, 0x01, methodNoAuth})
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatalf("Reading method selection: %v", err)
+	}
+	conn.Write([]byte{VERSION, cmdUDPAssociate, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	rep, _, err := readReply(conn)
+	if err != nil {
+		t.Fatalf("readReply() error = %v", err)
+	}
+	if rep != repCommandNotSupported {
+		t.Errorf("Reply = %d, want %d", rep, repCommandNotSupported)
+	}
+}
+
+func TestListenUnixSocketMovedIntoPlace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix domain socket permissions are not supported on Windows")
+	}
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "proxy.sock")
+
+	l, err := listen(config.Listener{Address: "unix:" + socket, Mode: "0600"})
+	if err != nil {
+		t.Fatalf("listen() error = %v", err)
+	}
+	if got := l.Addr().String(); got != socket {
+		t.Errorf("Addr() = %s, want %s", got, socket)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "proxy.sock" {
+		t.Errorf("Directory holds %v, want only the socket", entries)
+	}
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Stat() = %v, %v, want mode 600", info, err)
+	}
+
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to connect to %s: %v", socket, err)
+	}
+	conn.Close()
+
+	l.Close()
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Socket still exists after Close(): %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go-socks5-chain/config"
+)
+
+// pacPreamble normalizes the host and works out what the rules look at.
+// Hosts that are IP literals never match domain criteria.
+const pacPreamble = `function FindProxyForURL(url, host) {
+	host = host.toLowerCase().replace(/^\[|\]$/g, "").replace(/\.$/, "");
+	var ip4 = /^\d+\.\d+\.\d+\.\d+$/.test(host);
+	var ip = ip4 || host.indexOf(":") >= 0;
+	var m = /^[a-z][a-z0-9+.-]*:\/\/(?:[^@\/]*@)?(?:\[[^\]]*\]|[^:\/]*)(?::(\d+))?/i.exec(url);
+	var port = m && m[1] ? parseInt(m[1], 10) : /^(https|wss):/i.test(url) ? 443 : 80;
+`
+
+// startPAC serves a proxy auto-config file on addr until the server stops
+func (s *Server) startPAC(addr string) error {
+	if s.listener == nil {
+		return fmt.Errorf("proxy auto-config needs a TCP listener to point browsers at")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start PAC listener: %v", err)
+	}
+	s.pacServer = &http.Server{
+		Handler:           http.HandlerFunc(s.servePAC),
+		ReadHeaderTimeout: dialTimeout,
+	}
+	go s.pacServer.Serve(listener)
+	return nil
+}
+
+// servePAC answers requests for /proxy.pac and /wpad.dat. The script is
+// generated from the current rules on every request, and its ETag lets
+// browsers notice when it changed.
+func (s *Server) servePAC(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/proxy.pac" && r.URL.Path != "/wpad.dat" {
+		http.NotFound(w, r)
+		return
+	}
+	script := pacScript(s.config.Rules, s.pacProxy(r))
+	sum := sha256.Sum256([]byte(script))
+
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum[:8]))
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader(script))
+}
+
+// pacProxy returns the PAC directive pointing browsers at the listener.
+// When it listens on every address, browsers are pointed at the address
+// they fetched the PAC file from.
+func (s *Server) pacProxy(r *http.Request) string {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		} else if r.Host != "" {
+			host = r.Host
+		}
+	}
+	addr := net.JoinHostPort(host, port)
+	if s.config.ListenTLS != nil {
+		// Browsers can't speak SOCKS over TLS, but the listener also
+		// accepts HTTP proxy requests
+		return "HTTPS " + addr
+	}
+	return "SOCKS5 " + addr + "; SOCKS " + addr
+}
+
+// pacScript generates a PAC script that mirrors rules: connections a rule
+// sends direct go DIRECT, and everything else goes to proxy, which applies
+// the rules again. A browser doesn't know everything the rules can look at,
+// such as its address as the proxy sees it, so the script only sends a
+// connection DIRECT when it is sure the proxy would have.
+func pacScript(rules []config.Rule, proxy string) string {
+	// Rules after the last direct one all end up at the proxy
+	last := -1
+	for i, rule := range rules {
+		if rule.Action == config.RouteDirect {
+			last = i
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(pacPreamble)
+	for _, rule := range rules[:last+1] {
+		result := proxy
+		if rule.Action == config.RouteDirect {
+			result = "DIRECT"
+		}
+		fmt.Fprintf(&b, "\t// %s\n", strings.Join(strings.Fields(rule.String()), " "))
+		fmt.Fprintf(&b, "\tif (%s) return %s;\n", pacCondition(rule), jsString(result))
+	}
+	fmt.Fprintf(&b, "\treturn %s;\n}\n", jsString(proxy))
+	return b.String()
+}
+
+// pacCondition translates a rule into a JavaScript condition. Entries the
+// script can't evaluate count as a match for rules that go to the proxy and
+// as no match for direct rules.
+func pacCondition(rule config.Rule) string {
+	unknown := "true"
+	if rule.Action == config.RouteDirect {
+		unknown = "false"
+	}
+
+	var criteria []string
+	add := func(entries []string, translate func(string) string) {
+		if len(entries) == 0 {
+			return
+		}
+		var alternatives []string
+		for _, entry := range entries {
+			alternative := translate(entry)
+			if alternative == "" {
+				alternative = unknown
+			}
+			alternatives = append(alternatives, alternative)
+		}
+		criteria = append(criteria, "("+strings.Join(alternatives, " || ")+")")
+	}
+
+	add(rule.Domains, func(pattern string) string {
+		pattern = strings.TrimPrefix(strings.ToLower(pattern), ".")
+		if strings.ContainsAny(pattern, `[\`) {
+			return ""
+		}
+		if strings.Contains(pattern, "*") {
+			return fmt.Sprintf("!ip && shExpMatch(host, %s)", jsString(pattern))
+		}
+		return fmt.Sprintf("!ip && (host == %s || dnsDomainIs(host, %s))", jsString(pattern), jsString("."+pattern))
+	})
+	add(rule.Networks, func(entry string) string {
+		// isInNet resolves names and only knows IPv4, so it is only used
+		// on IPv4 literals
+		network, err := config.ParseNetwork(entry)
+		if err != nil || len(network.Mask) != net.IPv4len {
+			return ""
+		}
+		return fmt.Sprintf("ip4 && isInNet(host, %s, %s)", jsString(network.IP.String()), jsString(net.IP(network.Mask).String()))
+	})
+	add(rule.Ports, func(entry string) string {
+		lo, hi, err := config.ParsePortRange(entry)
+		if err != nil {
+			return ""
+		}
+		if lo == hi {
+			return fmt.Sprintf("port == %d", lo)
+		}
+		return fmt.Sprintf("port >= %d && port <= %d", lo, hi)
+	})
+	add(rule.Sources, func(string) string { return "" })
+	add(rule.Listeners, func(string) string { return "" })
+
+	if len(criteria) == 0 {
+		return "true"
+	}
+	return strings.Join(criteria, " && ")
+}
+
+// jsString quotes s as a JavaScript string literal
+func jsString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go-socks5-chain/config"
+)
+
+func TestPACScript(t *testing.T) {
+	rules, err := config.ParseRules("direct domain=corp.example.com,*.intra.* ; reject port=25 ; direct net=10.0.0.0/8,fd00::/8 port=80,8000-8100 ; direct source=192.168.0.0/16 ; chain:alt domain=example.org")
+	if err != nil {
+		t.Fatalf("ParseRules() error = %v", err)
+	}
+	script := pacScript(rules, "SOCKS5 127.0.0.1:1080")
+
+	for _, want := range []string{
+		"function FindProxyForURL(url, host) {",
+		"\t// direct domain=corp.example.com,*.intra.*\n",
+		`if ((!ip && (host == "corp.example.com" || dnsDomainIs(host, ".corp.example.com")) || !ip && shExpMatch(host, "*.intra.*"))) return "DIRECT";`,
+		`if ((port == 25)) return "SOCKS5 127.0.0.1:1080";`,
+		// IPv6 networks can't be checked, so they never send a connection direct
+		`if ((ip4 && isInNet(host, "10.0.0.0", "255.0.0.0") || false) && (port == 80 || port >= 8000 && port <= 8100)) return "DIRECT";`,
+		// Neither can the client's address as the proxy sees it
+		`if ((false)) return "DIRECT";`,
+		"\treturn \"SOCKS5 127.0.0.1:1080\";\n}\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("pacScript() is missing %q:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "example.org") {
+		t.Errorf("pacScript() kept a rule after the last direct one:\n%s", script)
+	}
+
+	if got, want := pacScript(nil, "SOCKS5 127.0.0.1:1080"), pacPreamble+"\treturn \"SOCKS5 127.0.0.1:1080\";\n}\n"; got != want {
+		t.Errorf("pacScript() without rules = %q, want %q", got, want)
+	}
+}
+
+func TestServePAC(t *testing.T) {
+	listenOn := func(addr string) net.Listener {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to create listener: %v", err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		return listener
+	}
+	get := func(server *Server, path, host, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = host
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		server.servePAC(rec, req)
+		return rec
+	}
+
+	server := NewServer(&config.Config{Rules: []config.Rule{{Domains: []string{"localhost"}, Action: config.RouteDirect}}})
+	server.listener = listenOn("127.0.0.1:0")
+	port := server.listener.Addr().(*net.TCPAddr).Port
+
+	rec := get(server, "/proxy.pac", "pac.example.com:8081", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ns-proxy-autoconfig" {
+		t.Fatalf("GET /proxy.pac = %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	directive := "SOCKS5 127.0.0.1:" + strconv.Itoa(port)
+	if body := rec.Body.String(); !strings.Contains(body, directive) || !strings.Contains(body, `"localhost"`) {
+		t.Errorf("PAC script doesn't point at %s or misses the rules:\n%s", directive, body)
+	}
+
+	// Unchanged scripts revalidate, changed ones don't
+	etag := rec.Header().Get("ETag")
+	if rec := get(server, "/wpad.dat", "pac.example.com:8081", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("GET /wpad.dat with the current ETag = %d, want %d", rec.Code, http.StatusNotModified)
+	}
+	server.config.Rules = nil
+	if rec := get(server, "/proxy.pac", "pac.example.com:8081", etag); rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "localhost") {
+		t.Errorf("GET /proxy.pac after the rules changed = %d, want the new script", rec.Code)
+	}
+
+	if rec := get(server, "/other", "pac.example.com:8081", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /other = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	// A listener on every address is reached at the address the PAC file came from
+	server.listener = listenOn("0.0.0.0:0")
+	server.config.ListenTLS = &config.ListenTLS{CertFile: "cert.pem", KeyFile: "key.pem"}
+	port = server.listener.Addr().(*net.TCPAddr).Port
+	want := `return "HTTPS 192.0.2.1:` + strconv.Itoa(port) + `";`
+	if body := get(server, "/proxy.pac", "192.0.2.1:8081", "").Body.String(); !strings.Contains(body, want) {
+		t.Errorf("PAC script doesn't contain %s:\n%s", want, body)
+	}
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"go-socks5-chain/config"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// Backoff for endpoints that failed, doubled on every further failure
+	minEndpointBackoff = time.Second
+	maxEndpointBackoff = 5 * time.Minute
+
+	// defaultHealthCheckInterval is used when the config doesn't set one
+	defaultHealthCheckInterval = 30 * time.Second
+)
+
+// endpointState is what the pool knows about one upstream endpoint
+type endpointState struct {
+	failures int
+	retryAt  time.Time // Not used before this time unless nothing else is left
+	active   int       // Connections currently open through the endpoint
+	latency  time.Duration
+}
+
+// upstreamPool tracks the health of the primary upstream's endpoints and
+// decides the order in which they are tried. State is kept by address, so
+// it follows changes to the configured endpoints.
+type upstreamPool struct {
+	mu        sync.Mutex
+	states    map[string]*endpointState
+	balancers map[string]balancer // By strategy name, created on first use
+	now       func() time.Time
+}
+
+func newUpstreamPool() *upstreamPool {
+	return &upstreamPool{
+		states:    make(map[string]*endpointState),
+		balancers: make(map[string]balancer),
+		now:       time.Now,
+	}
+}
+
+// state returns the state for endpoint, creating it if needed. The caller
+// must hold p.mu.
+func (p *upstreamPool) state(endpoint config.Endpoint) *endpointState {
+	st := p.states[endpoint.Addr()]
+	if st == nil {
+		st = &endpointState{}
+		p.states[endpoint.Addr()] = st
+	}
+	return st
+}
+
+// order returns endpoints in the order they should be tried for a
+// connection from source to target: the available ones as the named
+// balancing strategy orders them, then the ones backing off, soonest retry
+// first
+func (p *upstreamPool) order(endpoints []config.Endpoint, strategy string, source net.Addr, target string) []config.Endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	var available []candidate
+	var backingOff []config.Endpoint
+	for _, endpoint := range endpoints {
+		st := p.state(endpoint)
+		if st.retryAt.After(now) {
+			backingOff = append(backingOff, endpoint)
+			continue
+		}
+		weight := endpoint.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		available = append(available, candidate{endpoint: endpoint, weight: weight, active: st.active, latency: st.latency})
+	}
+	sort.SliceStable(backingOff, func(i, j int) bool {
+		return p.state(backingOff[i]).retryAt.Before(p.state(backingOff[j]).retryAt)
+	})
+
+	b := p.balancers[strategy]
+	if b == nil {
+		b = newBalancer(strategy)
+		p.balancers[strategy] = b
+	}
+	ordered := make([]config.Endpoint, 0, len(endpoints))
+	for _, c := range b.order(available, source, target) {
+		ordered = append(ordered, c.endpoint)
+	}
+	return append(ordered, backingOff...)
+}
+
+// markFailure records a failure and backs the endpoint off exponentially
+func (p *upstreamPool) markFailure(endpoint config.Endpoint) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st := p.state(endpoint)
+	st.failures++
+	backoff := minEndpointBackoff
+	for i := 1; i < st.failures && backoff < maxEndpointBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxEndpointBackoff {
+		backoff = maxEndpointBackoff
+	}
+	st.retryAt = p.now().Add(backoff)
+	return backoff
+}
+
+// markSuccess clears the endpoint's failures
+func (p *upstreamPool) markSuccess(endpoint config.Endpoint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st := p.state(endpoint)
+	st.failures = 0
+	st.retryAt = time.Time{}
+}
+
+// markLatency records how long a successful health check of the endpoint took
+func (p *upstreamPool) markLatency(endpoint config.Endpoint, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.state(endpoint).latency = latency
+}
+
+// track counts conn as active on endpoint until it is closed
+func (p *upstreamPool) track(endpoint config.Endpoint, conn net.Conn) net.Conn {
+	p.mu.Lock()
+	p.state(endpoint).active++
+	p.mu.Unlock()
+
+	return &trackedConn{Conn: conn, release: func() {
+		p.mu.Lock()
+		p.state(endpoint).active--
+		p.mu.Unlock()
+	}}
+}
+
+// dialUpstream connects to target through the upstream chain for a client
+// at source, failing over between the primary upstream's endpoints in the
+// order the balancing strategy picks. asDomain is passed on to dialChain.
+// Only failures to reach or set up the first hop move on to the next
+// endpoint; anything after that would fail the same way through every
+// endpoint.
+func (s *Server) dialUpstream(source net.Addr, target string, asDomain bool) (net.Conn, string, error) {
+	endpoints := s.config.UpstreamEndpoints()
+	var lastErr error
+	for _, endpoint := range s.pool.order(endpoints, s.config.Balance, source, target) {
+		conn, bound, err := s.dialChain(s.config.HopsVia(endpoint), target, asDomain)
+		var epErr *endpointError
+		if errors.As(err, &epErr) {
+			backoff := s.pool.markFailure(endpoint)
+			if len(endpoints) > 1 {
+				log.Printf("Upstream endpoint %s failed, backing off for %v: %v", endpoint.Addr(), backoff, err)
+			}
+			lastErr = err
+			continue
+		}
+		s.pool.markSuccess(endpoint)
+		if err != nil {
+			return nil, "", err
+		}
+		return s.pool.track(endpoint, conn), bound, nil
+	}
+	return nil, "", lastErr
+}
+
+// runHealthChecks probes every endpoint of the primary upstream until the
+// server shuts down
+func (s *Server) runHealthChecks() {
+	interval := defaultHealthCheckInterval
+	if s.config.HealthCheckInterval > 0 {
+		interval = time.Duration(s.config.HealthCheckInterval) * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.checkEndpoints()
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkEndpoints probes every endpoint once and updates the pool
+func (s *Server) checkEndpoints() {
+	for _, endpoint := range s.config.UpstreamEndpoints() {
+		start := time.Now()
+		if err := s.probeEndpoint(endpoint); err != nil {
+			backoff := s.pool.markFailure(endpoint)
+			log.Printf("Health check of upstream endpoint %s failed, backing off for %v: %v", endpoint.Addr(), backoff, err)
+		} else {
+			s.pool.markSuccess(endpoint)
+			s.pool.markLatency(endpoint, time.Since(start))
+		}
+	}
+}
+
+// probeEndpoint connects to an endpoint and runs the same handshake and
+// authentication a client connection would
+func (s *Server) probeEndpoint(endpoint config.Endpoint) error {
+	hop := s.config.HopsVia(endpoint)[0]
+	conn, err := net.DialTimeout("tcp", hop.Addr(), dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if hop.IsSSH() {
+		cfg, err := sshClientConfig(hop)
+		if err != nil {
+			return err
+		}
+		conn.SetDeadline(time.Now().Add(dialTimeout))
+		c, _, _, err := ssh.NewClientConn(conn, hop.Addr(), cfg)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+
+	_, err = s.openHop(conn, hop)
+	return err
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"go-socks5-chain/config"
+)
+
+func TestUpstreamPoolBackoff(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	pool := newUpstreamPool()
+	pool.now = func() time.Time { return now }
+
+	a := config.Endpoint{Host: "a.example.com", Port: 1080}
+	b := config.Endpoint{Host: "b.example.com", Port: 1080}
+	c := config.Endpoint{Host: "c.example.com", Port: 1080}
+	endpoints := []config.Endpoint{a, b, c}
+
+	wantBackoffs := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	for i, want := range wantBackoffs {
+		if got := pool.markFailure(a); got != want {
+			t.Errorf("markFailure() #%d backoff = %v, want %v", i+1, got, want)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		pool.markFailure(c)
+	}
+	if got := pool.markFailure(c); got != maxEndpointBackoff {
+		t.Errorf("markFailure() backoff = %v, want it capped at %v", got, maxEndpointBackoff)
+	}
+
+	// Backing off endpoints go last, soonest retry first
+	want := []config.Endpoint{b, a, c}
+	if got := pool.order(endpoints, config.BalanceFailover, nil, ""); !equalEndpoints(got, want) {
+		t.Errorf("order() = %v, want %v", got, want)
+	}
+
+	// Once the backoff expires the configured order is restored
+	now = now.Add(10 * time.Second)
+	want = []config.Endpoint{a, b, c}
+	if got := pool.order(endpoints, config.BalanceFailover, nil, ""); !equalEndpoints(got, want) {
+		t.Errorf("order() after a's backoff = %v, want %v", got, want)
+	}
+
+	pool.markSuccess(c)
+	if got := pool.order(endpoints, config.BalanceFailover, nil, ""); !equalEndpoints(got, endpoints) {
+		t.Errorf("order() after c recovered = %v, want %v", got, endpoints)
+	}
+	if got := pool.markFailure(c); got != minEndpointBackoff {
+		t.Errorf("markFailure() after success backoff = %v, want %v", got, minEndpointBackoff)
+	}
+}
+
+func equalEndpoints(a, b []config.Endpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func closedEndpoint(t *testing.T) config.Endpoint {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	return config.Endpoint{Host: "127.0.0.1", Port: port}
+}
+
+func TestDialUpstreamFailover(t *testing.T) {
+	echo := startEchoServer(t)
+	down := closedEndpoint(t)
+	relay := startRelayUpstream(t, "user", "pass")
+	hop := relay.hop()
+
+	server := NewServer(&config.Config{
+		Username:     "user",
+		Password:     "pass",
+		UpstreamHost: down.Host,
+		UpstreamPort: down.Port,
+		Endpoints:    []config.Endpoint{{Host: hop.Host, Port: hop.Port}},
+	})
+
+	for i := 0; i < 2; i++ {
+		conn, _, err := server.dialTarget("", nil, echo.Addr().String(), false)
+		if err != nil {
+			t.Fatalf("dialTarget() #%d error = %v", i+1, err)
+		}
+		echoThrough(t, conn, "failover")
+		conn.Close()
+	}
+
+	// The failed endpoint is backing off and tried last
+	order := server.pool.order(server.config.UpstreamEndpoints(), config.BalanceFailover, nil, "")
+	if order[0] != server.config.Endpoints[0] {
+		t.Errorf("order() = %v, want the healthy endpoint first", order)
+	}
+	if got := len(relay.requestedTargets()); got != 2 {
+		t.Errorf("Healthy endpoint handled %d requests, want 2", got)
+	}
+}
+
+func TestDialUpstreamNoFailoverForTargetErrors(t *testing.T) {
+	refusing := startReplyUpstream(t, true, repHostUnreachable, "0.0.0.0:0")
+	relay := startRelayUpstream(t, "user", "pass")
+	hop := relay.hop()
+
+	server := NewServer(&config.Config{
+		Username:     "user",
+		Password:     "pass",
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: refusing.Addr().(*net.TCPAddr).Port,
+		Endpoints:    []config.Endpoint{{Host: hop.Host, Port: hop.Port}},
+	})
+
+	_, _, err := server.dialTarget("", nil, "unreachable.example.com:80", false)
+	var re *replyError
+	if !errors.As(err, &re) || re.rep != repHostUnreachable {
+		t.Fatalf("dialTarget() error = %v, want the first endpoint's host unreachable reply", err)
+	}
+	if got := relay.requestedTargets(); len(got) != 0 {
+		t.Errorf("Second endpoint was asked for %v, want no failover for target errors", got)
+	}
+}
+
+func TestDialUpstreamAllEndpointsDown(t *testing.T) {
+	first, second := closedEndpoint(t), closedEndpoint(t)
+	server := NewServer(&config.Config{
+		UpstreamHost: first.Host,
+		UpstreamPort: first.Port,
+		Endpoints:    []config.Endpoint{second},
+	})
+
+	_, _, err := server.dialTarget("", nil, "example.com:80", false)
+	if err == nil {
+		t.Fatal("dialTarget() succeeded with every endpoint down")
+	}
+	if got := replyCode(err); got != repGeneralFailure {
+		t.Errorf("replyCode(%v) = %d, want %d", err, got, repGeneralFailure)
+	}
+}
+
+func TestCheckEndpoints(t *testing.T) {
+	relay := startRelayUpstream(t, "user", "pass").hop()
+	badAuth := startReplyUpstream(t, false, repSuccess, "0.0.0.0:0")
+	down := closedEndpoint(t)
+
+	healthy := config.Endpoint{Host: relay.Host, Port: relay.Port}
+	rejecting := config.Endpoint{Host: "127.0.0.1", Port: badAuth.Addr().(*net.TCPAddr).Port}
+	server := NewServer(&config.Config{
+		Username:     "user",
+		Password:     "pass",
+		UpstreamHost: down.Host,
+		UpstreamPort: down.Port,
+		Endpoints:    []config.Endpoint{rejecting, healthy},
+	})
+
+	server.checkEndpoints()
+
+	want := []config.Endpoint{healthy, down, rejecting}
+	if got := server.pool.order(server.config.UpstreamEndpoints(), config.BalanceFailover, nil, ""); !equalEndpoints(got, want) {
+		t.Errorf("order() after health checks = %v, want %v", got, want)
+	}
+}
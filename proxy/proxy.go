@@ -1,11 +1,15 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 
@@ -14,14 +18,54 @@ import (
 
 const (
 	VERSION = 0x05
+
+	// Authentication methods
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xFF
+
+	// Commands
+	cmdConnect      = 0x01
+	cmdBind         = 0x02
+	cmdUDPAssociate = 0x03
+
+	// Reply codes
+	repSuccess             = 0x00
+	repGeneralFailure      = 0x01
+	repNotAllowed          = 0x02
+	repNetworkUnreachable  = 0x03
+	repHostUnreachable     = 0x04
+	repConnectionRefused   = 0x05
+	repTTLExpired          = 0x06
+	repCommandNotSupported = 0x07
+	repAddressNotSupported = 0x08
+
+	// dialTimeout bounds how long we wait for the first upstream hop
+	dialTimeout = 10 * time.Second
 )
 
 type Server struct {
 	config   *config.Config
-	listener net.Listener
+	listener net.Listener // The first TCP listener, which PAC files point browsers at
 	wg       sync.WaitGroup
 	ctx      context.Context
 	cancel   context.CancelFunc
+
+	sshSessions *sshSessions
+	pool        *upstreamPool
+	pacServer   *http.Server
+	dns         *dnsServer
+	forwards    []net.Listener
+	transparent net.Listener
+	tproxy      net.Listener
+	tproxyUDP   *tproxyUDP
+
+	mu        sync.Mutex // Guards listeners
+	listeners []*listener
+
+	// tlsConfig is set when the listeners serve TLS. The handshake happens
+	// per connection, after any PROXY protocol header.
+	tlsConfig *tls.Config
 }
 
 func NewServer(cfg *config.Config) *Server {
@@ -30,44 +74,78 @@ func NewServer(cfg *config.Config) *Server {
 		config: cfg,
 		ctx:    ctx,
 		cancel: cancel,
+
+		sshSessions: newSSHSessions(),
+		pool:        newUpstreamPool(),
 	}
 }
 
+// Start serves clients on addr, unless it is empty, and on every configured
+// listener. It returns once the server is stopped, or if a listener or
+// service fails to start.
 func (s *Server) Start(addr string) error {
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return fmt.Errorf("failed to start listener: %v", err)
+	specs := s.config.Listeners
+	if addr != "" {
+		specs = append([]config.Listener{{Address: addr}}, specs...)
+	}
+	if len(specs) == 0 {
+		return fmt.Errorf("no address to listen on")
+	}
+	if s.config.ListenTLS != nil {
+		tlsConfig, err := listenerTLSConfig(s.config.ListenTLS)
+		if err != nil {
+			return err
+		}
+		s.tlsConfig = tlsConfig
 	}
-	s.listener = listener
-
-	for {
-		select {
-		case <-s.ctx.Done():
-			return nil
-		default:
-			conn, err := listener.Accept()
-			if err != nil {
-				if err, ok := err.(*net.OpError); ok && err.Err.Error() == "use of closed network connection" {
-					return nil
-				}
-				log.Printf("Failed to accept connection: %v", err)
-				continue
-			}
 
-			s.wg.Add(1)
-			go s.handleConnection(conn)
+	s.mu.Lock()
+	for _, spec := range specs {
+		l, err := listen(spec)
+		if err != nil {
+			s.mu.Unlock()
+			s.closeListeners()
+			return fmt.Errorf("failed to start listener on %s: %v", spec.Address, err)
+		}
+		s.listeners = append(s.listeners, l)
+		if s.listener == nil && spec.Network() == "tcp" {
+			s.listener = l
 		}
 	}
+	stopped := s.ctx.Err() != nil
+	s.mu.Unlock()
+	if stopped {
+		// Stop came first and had nothing to close yet
+		s.closeListeners()
+		return nil
+	}
+
+	if err := s.startServices(); err != nil {
+		s.closeListeners()
+		s.closeServices()
+		return err
+	}
+	if len(s.config.Endpoints) > 0 {
+		go s.runHealthChecks()
+	}
+
+	for _, l := range s.listeners[1:] {
+		go s.serve(l)
+	}
+	s.serve(s.listeners[0])
+	return nil
 }
 
 func (s *Server) Stop() {
 	// Signal shutdown
 	s.cancel()
 
-	// Close listener to stop accepting new connections
-	if s.listener != nil {
-		s.listener.Close()
-	}
+	// Close listeners to stop accepting new connections
+	s.closeListeners()
+	s.closeServices()
+
+	// Shared SSH sessions carry the tunnels of existing connections
+	s.sshSessions.closeAll()
 
 	// Wait for existing connections with timeout
 	done := make(chan struct{})
@@ -85,34 +163,153 @@ func (s *Server) Stop() {
 	}
 }
 
-func (s *Server) handleConnection(client net.Conn) {
-	defer client.Close()
+func (s *Server) closeListeners() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+}
+
+// startServices starts the optional listeners besides the proxy itself
+func (s *Server) startServices() error {
+	if s.config.PACListen != "" {
+		if err := s.startPAC(s.config.PACListen); err != nil {
+			return err
+		}
+	}
+	if s.config.DNSListen != "" {
+		if err := s.startDNS(s.config.DNSListen); err != nil {
+			return err
+		}
+	}
+	if s.config.TransparentListen != "" {
+		if err := s.startTransparent(s.config.TransparentListen); err != nil {
+			return err
+		}
+	}
+	if s.config.TProxyListen != "" {
+		if err := s.startTProxy(s.config.TProxyListen); err != nil {
+			return err
+		}
+	}
+	if err := s.startForwards(); err != nil {
+		return err
+	}
+	return s.startReverse()
+}
+
+// closeServices stops whatever startServices started
+func (s *Server) closeServices() {
+	if s.pacServer != nil {
+		s.pacServer.Close()
+	}
+	if s.dns != nil {
+		s.dns.close()
+	}
+	if s.transparent != nil {
+		s.transparent.Close()
+	}
+	if s.tproxy != nil {
+		s.tproxy.Close()
+		s.tproxyUDP.close()
+	}
+	s.closeForwards()
+}
+
+func (s *Server) handleConnection(conn net.Conn, l *listener) {
+	defer conn.Close()
 	defer s.wg.Done()
 
+	if s.trustsProxyProtocol(conn.RemoteAddr()) {
+		proxied, err := readProxyHeader(conn)
+		if err != nil {
+			log.Printf("Invalid PROXY protocol header from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		conn = proxied
+	}
+
+	if s.tlsConfig != nil {
+		tlsConn := tls.Server(conn, s.tlsConfig)
+		defer tlsConn.Close()
+		if err := tlsHandshake(tlsConn); err != nil {
+			log.Printf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		conn = tlsConn
+	}
+
+	// Look at the first byte to tell SOCKS4, SOCKS5 and HTTP clients apart
+	client := newBufferedConn(conn)
+	first, err := client.r.Peek(1)
+	if err != nil {
+		return
+	}
+	switch {
+	case first[0] == socks4Version:
+		s.handleSOCKS4(client, l)
+		return
+	case isHTTPMethodByte(first[0]):
+		s.handleHTTP(client, l)
+		return
+	}
+
 	// SOCKS5 initial handshake
-	if err := s.handleInitialHandshake(client); err != nil {
+	if err := s.handleInitialHandshake(client, l); err != nil {
 		log.Printf("Initial handshake failed: %v", err)
 		return
 	}
 
 	// Handle SOCKS5 request
-	target, err := s.handleRequest(client)
+	req, err := s.handleRequest(client)
 	if err != nil {
 		log.Printf("Request handling failed: %v", err)
 		return
 	}
 
-	// Connect to upstream proxy
-	upstreamConn, err := s.connectToUpstream()
+	// CONNECT is routed when dialing, and UDP ASSOCIATE per datagram, as its
+	// address is the client's own. BIND always uses the upstream chain,
+	// unless a rule rejects it.
+	if req.cmd == cmdBind && s.route(l.id, client.RemoteAddr(), req.target).Action == config.RouteReject {
+		log.Printf("Command %d from %s for %s rejected by routing rule", req.cmd, client.RemoteAddr(), req.target)
+		s.sendReply(client, repNotAllowed, "")
+		return
+	}
+
+	// BIND and UDP ASSOCIATE can only be relayed by a SOCKS5 hop
+	if req.cmd != cmdConnect && !s.lastHop().IsSOCKS5() {
+		log.Printf("Command %d from %s is not supported through a %s upstream", req.cmd, client.RemoteAddr(), s.lastHop().Type)
+		s.sendReply(client, repCommandNotSupported, "")
+		return
+	}
+
+	switch req.cmd {
+	case cmdConnect:
+		s.handleConnect(client, req.target, req.domain, l)
+	case cmdBind:
+		s.handleBind(client, req.target)
+	case cmdUDPAssociate:
+		s.handleUDPAssociate(client, req.target, l)
+	default:
+		log.Printf("Unsupported command %d from %s", req.cmd, client.RemoteAddr())
+		s.sendReply(client, repCommandNotSupported, "")
+	}
+}
+
+// handleConnect serves a CONNECT request. The client only gets a success
+// reply, carrying the upstream's bound address, once the upstream has
+// accepted the request; failures are reported with a matching reply code.
+func (s *Server) handleConnect(client net.Conn, target string, domain bool, l *listener) {
+	upstreamConn, bound, err := s.dialTarget(l.id, client.RemoteAddr(), target, domain)
 	if err != nil {
-		log.Printf("Failed to connect to upstream: %v", err)
+		log.Printf("Failed to connect to %s through upstream: %v", target, err)
+		s.sendReply(client, replyCode(err), "")
 		return
 	}
 	defer upstreamConn.Close()
 
-	// Forward the connection request to upstream
-	if err := s.forwardRequest(upstreamConn, target); err != nil {
-		log.Printf("Failed to forward request: %v", err)
+	if err := s.sendReply(client, repSuccess, bound); err != nil {
 		return
 	}
 
@@ -120,7 +317,7 @@ func (s *Server) handleConnection(client net.Conn) {
 	s.forwardTraffic(client, upstreamConn)
 }
 
-func (s *Server) handleInitialHandshake(conn net.Conn) error {
+func (s *Server) handleInitialHandshake(conn net.Conn, l *listener) error {
 	// Read version and number of methods
 	header := make([]byte, 2)
 	if _, err := io.ReadFull(conn, header); err != nil {
@@ -137,145 +334,283 @@ func (s *Server) handleInitialHandshake(conn net.Conn) error {
 		return err
 	}
 
-	// Respond with no authentication required
-	_, err := conn.Write([]byte{VERSION, 0x00})
-	return err
-}
+	// Pick the method we require and make sure the client offers it
+	method := byte(methodNoAuth)
+	if s.authRequired(l) {
+		method = methodUserPass
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		conn.Write([]byte{VERSION, methodNoAcceptable})
+		return fmt.Errorf("no acceptable authentication methods offered by client")
+	}
 
-func (s *Server) handleRequest(conn net.Conn) (string, error) {
-	// Read request header
-	header := make([]byte, 4)
-	if _, err := io.ReadFull(conn, header); err != nil {
-		return "", err
+	if _, err := conn.Write([]byte{VERSION, method}); err != nil {
+		return err
 	}
 
-	if header[0] != VERSION {
-		return "", fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	if method == methodUserPass {
+		return s.authenticateClient(conn)
 	}
+	return nil
+}
 
-	// Read address type and address
-	var addr string
-	switch header[3] {
-	case 0x01: // IPv4
-		ipv4 := make([]byte, 4)
-		if _, err := io.ReadFull(conn, ipv4); err != nil {
-			return "", err
-		}
-		addr = net.IP(ipv4).String()
-	case 0x03: // Domain name
-		lenByte := make([]byte, 1)
-		if _, err := io.ReadFull(conn, lenByte); err != nil {
-			return "", err
-		}
-		domain := make([]byte, lenByte[0])
-		if _, err := io.ReadFull(conn, domain); err != nil {
-			return "", err
-		}
-		addr = string(domain)
-	case 0x04: // IPv6
-		ipv6 := make([]byte, 16)
-		if _, err := io.ReadFull(conn, ipv6); err != nil {
-			return "", err
-		}
-		addr = net.IP(ipv6).String()
-	default:
-		return "", fmt.Errorf("unsupported address type: %d", header[3])
+// request is a parsed SOCKS5 client request
+type request struct {
+	cmd    byte
+	target string
+	domain bool // The client sent the target as a domain name
+}
+
+func (s *Server) handleRequest(conn net.Conn) (*request, error) {
+	// Read request header and address type
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
 	}
 
-	// Read port
-	portBytes := make([]byte, 2)
-	if _, err := io.ReadFull(conn, portBytes); err != nil {
-		return "", err
+	if header[0] != VERSION {
+		return nil, fmt.Errorf("unsupported SOCKS version: %d", header[0])
 	}
-	port := int(portBytes[0])<<8 | int(portBytes[1])
 
-	// Send success response
-	response := []byte{VERSION, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
-	if _, err := conn.Write(response); err != nil {
-		return "", err
+	// Read address and port
+	target, err := readAddr(io.MultiReader(bytes.NewReader(header[3:]), conn))
+	if err != nil {
+		return nil, err
 	}
 
-	return fmt.Sprintf("%s:%d", addr, port), nil
+	return &request{cmd: header[1], target: target, domain: header[3] == atypDomain}, nil
 }
 
-func (s *Server) connectToUpstream() (net.Conn, error) {
-	upstreamAddr := fmt.Sprintf("%s:%d", s.config.UpstreamHost, s.config.UpstreamPort)
-	conn, err := net.Dial("tcp", upstreamAddr)
+// sendReply writes a SOCKS5 reply with the given code and bound host:port.
+// An empty bound address is sent as 0.0.0.0:0.
+func (s *Server) sendReply(conn net.Conn, rep byte, bound string) error {
+	if bound == "" {
+		bound = unspecifiedAddr
+	}
+	addr, err := encodeAddr(bound)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	_, err = conn.Write(append([]byte{VERSION, rep, 0x00}, addr...))
+	return err
+}
 
-	// SOCKS5 handshake with upstream
-	// Version + number of auth methods
-	_, err = conn.Write([]byte{VERSION, 0x01, 0x02})
+// readReply reads a SOCKS5 reply from an upstream and returns its reply
+// code and bound address. The length of the reply depends on the address
+// type, so exactly the reply is consumed and any data after it is left in r.
+func readReply(r io.Reader) (byte, string, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != VERSION {
+		return 0, "", fmt.Errorf("unexpected SOCKS version in reply: %d", header[0])
+	}
+	bound, err := readAddr(r)
 	if err != nil {
-		conn.Close()
-		return nil, err
+		return 0, "", fmt.Errorf("invalid bound address in reply: %w", err)
 	}
+	return header[1], bound, nil
+}
 
-	// Read auth method selection
-	response := make([]byte, 2)
-	if _, err := io.ReadFull(conn, response); err != nil {
-		conn.Close()
-		return nil, err
+// lastHop returns the upstream hop that receives the client's request
+func (s *Server) lastHop() config.Hop {
+	hops := s.config.Hops()
+	return hops[len(hops)-1]
+}
+
+// connectToUpstream dials the first hop of the chain for the client at
+// source and sets up every hop in turn, tunneling through the previous ones.
+// The returned connection is ready for a SOCKS5 request to the last hop.
+func (s *Server) connectToUpstream(source net.Addr) (net.Conn, error) {
+	hops := s.config.Hops()
+	if !hops[len(hops)-1].IsSOCKS5() {
+		return nil, fmt.Errorf("last upstream hop is not a SOCKS5 proxy")
 	}
+	conn, _, err := s.dialUpstream(source, "", false)
+	return conn, err
+}
 
-	// Authenticate with upstream
-	auth := []byte{0x01}                              // Username/Password auth version
-	auth = append(auth, byte(len(s.config.Username))) // Username length
-	auth = append(auth, []byte(s.config.Username)...) // Username
-	auth = append(auth, byte(len(s.config.Password))) // Password length
-	auth = append(auth, []byte(s.config.Password)...) // Password
-	if _, err := conn.Write(auth); err != nil {
-		conn.Close()
-		return nil, err
+// dialChain walks hops and connects through them to target. With an empty
+// target it stops once the last hop is set up. asDomain makes a SOCKS5 last
+// hop get the target's host as a domain name even if it is an IP literal.
+// A broken SSH session is only noticed when it is reused, so the walk is
+// retried once in that case.
+func (s *Server) dialChain(hops []config.Hop, target string, asDomain bool) (net.Conn, string, error) {
+	conn, bound, err := s.walkChain(hops, target, asDomain)
+	if errors.Is(err, errSSHSessionLost) {
+		conn, bound, err = s.walkChain(hops, target, asDomain)
 	}
+	return conn, bound, err
+}
 
-	// Read auth response
-	authResponse := make([]byte, 2)
-	if _, err := io.ReadFull(conn, authResponse); err != nil {
-		conn.Close()
-		return nil, err
+// walkChain does a single attempt for dialChain. At every hop it arrives
+// with a connection to the hop, sets the hop up and asks it to connect to
+// the next hop or the target. SSH hops turn into sessions that are shared
+// between client connections, so the walk starts at the furthest hop that
+// already has one.
+func (s *Server) walkChain(hops []config.Hop, target string, asDomain bool) (net.Conn, string, error) {
+	start, session := s.sshSessions.resume(hops)
+	resumed := session != nil
+
+	var conn net.Conn
+	if !resumed {
+		var err error
+		conn, err = net.DialTimeout("tcp", hops[0].Addr(), dialTimeout)
+		if err != nil {
+			return nil, "", &endpointError{err}
+		}
 	}
 
-	if authResponse[1] != 0x00 {
-		conn.Close()
-		return nil, fmt.Errorf("upstream authentication failed")
+	var bound string
+	for i := start; i < len(hops); i++ {
+		hop := hops[i]
+		if i > start || !resumed {
+			var err error
+			if hop.IsSSH() {
+				session, err = s.sshSessions.open(conn, hops[:i+1])
+			} else {
+				var opened net.Conn
+				if opened, err = s.openHop(conn, hop); err == nil {
+					conn = opened
+				}
+			}
+			if err != nil {
+				conn.Close()
+				if len(hops) > 1 {
+					err = fmt.Errorf("hop %d (%s): %w", i+1, hop.Addr(), err)
+				}
+				if i == 0 {
+					err = &endpointError{err}
+				}
+				return nil, "", err
+			}
+		}
+
+		next, nextAsDomain := target, asDomain
+		if i+1 < len(hops) {
+			next, nextAsDomain = hops[i+1].Addr(), false
+		} else if target == "" {
+			break
+		}
+
+		var err error
+		if hop.IsSSH() {
+			conn, err = s.sshSessions.dial(session, hops[:i+1], next)
+			bound = ""
+		} else {
+			bound, err = s.requestConnect(conn, hop, next, nextAsDomain)
+			if err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			if i+1 < len(hops) {
+				return nil, "", fmt.Errorf("hop %d (%s) unreachable: %w", i+2, next, err)
+			}
+			return nil, "", err
+		}
 	}
 
-	return conn, nil
+	return conn, bound, nil
 }
 
-func (s *Server) forwardRequest(conn net.Conn, target string) error {
-	host, port, err := net.SplitHostPort(target)
-	if err != nil {
-		return err
+// openHop prepares a connection that has just reached a SOCKS5 or HTTP hop:
+// it starts TLS if the hop uses it and runs the SOCKS5 handshake for SOCKS5
+// hops. HTTP hops authenticate with each CONNECT request instead. Both
+// steps together must finish within dialTimeout, so a hop that goes silent
+// halfway can't hold up the caller.
+func (s *Server) openHop(conn net.Conn, hop config.Hop) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if hop.TLS {
+		tlsConfig, err := hopTLSConfig(hop)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		conn = tlsConn
 	}
 
-	// Build SOCKS5 connect request
-	request := []byte{VERSION, 0x01, 0x00, 0x03}
-	request = append(request, byte(len(host)))
-	request = append(request, []byte(host)...)
+	if !hop.IsHTTP() {
+		if err := s.upstreamHandshake(conn, hop); err != nil {
+			return nil, err
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
 
-	portNum := 0
-	fmt.Sscanf(port, "%d", &portNum)
-	request = append(request, byte(portNum>>8), byte(portNum&0xff))
+// requestConnect asks hop, already set up on conn, to connect to target and
+// returns the bound address it reports, if any. asDomain is passed on to
+// forwardRequest.
+func (s *Server) requestConnect(conn net.Conn, hop config.Hop, target string, asDomain bool) (string, error) {
+	if hop.IsHTTP() {
+		return "", httpConnect(conn, hop, target)
+	}
+	return s.forwardRequest(conn, target, asDomain)
+}
 
-	if _, err := conn.Write(request); err != nil {
+// upstreamHandshake negotiates an authentication method with a single
+// upstream hop and authenticates if the hop asks for it. No-auth is always
+// offered; username/password only when the hop has credentials configured.
+func (s *Server) upstreamHandshake(conn net.Conn, hop config.Hop) error {
+	methods := []byte{methodNoAuth}
+	if hop.Username != "" {
+		methods = append(methods, methodUserPass)
+	}
+	greeting := append([]byte{VERSION, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
 		return err
 	}
 
-	// Read response
-	response := make([]byte, 10)
+	// Read auth method selection
+	response := make([]byte, 2)
 	if _, err := io.ReadFull(conn, response); err != nil {
 		return err
 	}
+	if response[0] != VERSION {
+		return fmt.Errorf("unexpected SOCKS version from upstream: %d", response[0])
+	}
 
-	if response[1] != 0x00 {
-		return fmt.Errorf("upstream connection failed: %d", response[1])
+	switch response[1] {
+	case methodNoAcceptable:
+		return errNoAcceptableMethods
+	case methodNoAuth:
+		return nil
+	case methodUserPass:
+		if hop.Username == "" {
+			return fmt.Errorf("upstream requires username/password but none is configured")
+		}
+		return authenticateUpstream(conn, hop)
+	default:
+		return fmt.Errorf("upstream selected unsupported authentication method: %d", response[1])
 	}
+}
 
-	return nil
+// forwardRequest sends a CONNECT for target to the upstream and returns the
+// bound address from its reply. IP literals are sent as addresses unless
+// asDomain is set, in which case the host is always sent as a domain name.
+func (s *Server) forwardRequest(conn net.Conn, target string, asDomain bool) (string, error) {
+	addr, err := encodeAddrAs(target, asDomain)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := conn.Write(append([]byte{VERSION, cmdConnect, 0x00}, addr...)); err != nil {
+		return "", err
+	}
+
+	rep, bound, err := readReply(conn)
+	if err != nil {
+		return "", err
+	}
+	if rep != repSuccess {
+		return "", &replyError{rep: rep}
+	}
+	return bound, nil
 }
 
 func (s *Server) forwardTraffic(client, upstream net.Conn) {
@@ -286,8 +621,8 @@ func (s *Server) forwardTraffic(client, upstream net.Conn) {
 	go func() {
 		defer wg.Done()
 		io.Copy(upstream, client)
-		if tcpConn, ok := upstream.(*net.TCPConn); ok {
-			tcpConn.CloseWrite()
+		if cw, ok := upstream.(closeWriter); ok {
+			cw.CloseWrite()
 		}
 	}()
 
@@ -295,8 +630,8 @@ func (s *Server) forwardTraffic(client, upstream net.Conn) {
 	go func() {
 		defer wg.Done()
 		io.Copy(client, upstream)
-		if tcpConn, ok := client.(*net.TCPConn); ok {
-			tcpConn.CloseWrite()
+		if cw, ok := client.(closeWriter); ok {
+			cw.CloseWrite()
 		}
 	}()
 
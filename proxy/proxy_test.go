@@ -2,9 +2,12 @@ package proxy
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"net"
+	"os"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -180,7 +183,7 @@ func TestHandleInitialHandshake(t *testing.T) {
 			conn := NewMockConn()
 			conn.AddReadData(tt.input)
 
-			err := server.handleInitialHandshake(conn)
+			err := server.handleInitialHandshake(conn, &listener{})
 			if (err != nil) != tt.wantError {
 				t.Errorf("handleInitialHandshake() error = %v, wantError %v", err, tt.wantError)
 				return
@@ -241,7 +244,7 @@ func TestHandleRequest(t *testing.T) {
 				0x00, 0x50, // Port: 80
 			},
 			wantError:    false,
-			expectedAddr: "2001:db8::1:80",
+			expectedAddr: "[2001:db8::1]:80",
 		},
 		{
 			name: "Invalid SOCKS version",
@@ -275,28 +278,78 @@ func TestHandleRequest(t *testing.T) {
 			conn := NewMockConn()
 			conn.AddReadData(tt.input)
 
-			addr, err := server.handleRequest(conn)
+			req, err := server.handleRequest(conn)
 			if (err != nil) != tt.wantError {
 				t.Errorf("handleRequest() error = %v, wantError %v", err, tt.wantError)
 				return
 			}
 
 			if !tt.wantError {
-				if addr != tt.expectedAddr {
-					t.Errorf("handleRequest() addr = %v, want %v", addr, tt.expectedAddr)
+				if req.target != tt.expectedAddr {
+					t.Errorf("handleRequest() target = %v, want %v", req.target, tt.expectedAddr)
+				}
+				if req.cmd != 0x01 {
+					t.Errorf("handleRequest() cmd = %v, want %v", req.cmd, 0x01)
 				}
 
-				// Check that success response was written
-				written := conn.GetWrittenData()
-				expected := []byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
-				if !bytes.Equal(written, expected) {
-					t.Errorf("handleRequest() wrote %v, want %v", written, expected)
+				// The reply is only sent once the upstream has answered
+				if written := conn.GetWrittenData(); len(written) != 0 {
+					t.Errorf("handleRequest() wrote %v, want nothing", written)
 				}
 			}
 		})
 	}
 }
 
+func TestHandleRequestUDPAssociate(t *testing.T) {
+	server := NewServer(&config.Config{})
+
+	conn := NewMockConn()
+	conn.AddReadData([]byte{
+		0x05, 0x03, 0x00, 0x01, // SOCKS5, UDP ASSOCIATE, reserved, IPv4
+		0, 0, 0, 0, // Client address not known yet
+		0x00, 0x00,
+	})
+
+	req, err := server.handleRequest(conn)
+	if err != nil {
+		t.Fatalf("handleRequest() error = %v", err)
+	}
+	if req.cmd != 0x03 {
+		t.Errorf("handleRequest() cmd = %v, want %v", req.cmd, 0x03)
+	}
+	if req.target != "0.0.0.0:0" {
+		t.Errorf("handleRequest() target = %v, want %v", req.target, "0.0.0.0:0")
+	}
+	// The reply carries the relay address, so it must not be sent yet
+	if written := conn.GetWrittenData(); len(written) != 0 {
+		t.Errorf("handleRequest() wrote %v for UDP ASSOCIATE, want nothing", written)
+	}
+}
+
+func TestHandleConnectionUnsupportedCommand(t *testing.T) {
+	server := NewServer(&config.Config{})
+
+	conn := NewMockConn()
+	conn.AddReadData([]byte{0x05, 0x01, 0x00})
+	conn.AddReadData([]byte{
+		0x05, 0x09, 0x00, 0x01, // SOCKS5, unknown command, reserved, IPv4
+		192, 168, 1, 1,
+		0x00, 0x50,
+	})
+
+	server.wg.Add(1)
+	server.handleConnection(conn, &listener{})
+
+	expected := []byte{
+		0x05, 0x00, // Handshake reply
+		0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0, // Command not supported
+	}
+	if written := conn.GetWrittenData(); !bytes.Equal(written, expected) {
+		t.Errorf("handleConnection() wrote %v, want %v", written, expected)
+	}
+}
+
 func TestForwardRequest(t *testing.T) {
 	cfg := &config.Config{
 		Username:     "testuser",
@@ -307,20 +360,24 @@ func TestForwardRequest(t *testing.T) {
 	server := NewServer(cfg)
 
 	tests := []struct {
-		name       string
-		target     string
-		response   []byte
-		wantError  bool
-		wantOutput []byte
+		name         string
+		target       string
+		asDomain     bool
+		response     []byte
+		wantError    bool
+		wantOutput   []byte
+		wantBound    string
+		wantTrailing []byte
 	}{
 		{
 			name:   "Successful forward",
 			target: "example.com:80",
 			response: []byte{
 				0x05, 0x00, 0x00, 0x01, // Success response
-				0, 0, 0, 0, 0, 0, // Bound address (ignored)
+				10, 1, 2, 3, 0x11, 0xd7, // Bound address 10.1.2.3:4567
 			},
 			wantError: false,
+			wantBound: "10.1.2.3:4567",
 			wantOutput: []byte{
 				0x05, 0x01, 0x00, 0x03, // SOCKS5, CONNECT, reserved, domain
 				0x0b,                    // Domain length: 11
@@ -328,6 +385,101 @@ func TestForwardRequest(t *testing.T) {
 				0x00, 0x50, // Port: 80
 			},
 		},
+		{
+			name:     "IPv4 literal target",
+			target:   "192.0.2.1:443",
+			response: []byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+			wantOutput: []byte{
+				0x05, 0x01, 0x00, 0x01, // SOCKS5, CONNECT, reserved, IPv4
+				192, 0, 2, 1,
+				0x01, 0xbb, // Port: 443
+			},
+			wantBound: "0.0.0.0:0",
+		},
+		{
+			name:     "IPv6 literal target",
+			target:   "[2001:db8::1]:443",
+			response: []byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+			wantOutput: []byte{
+				0x05, 0x01, 0x00, 0x04, // SOCKS5, CONNECT, reserved, IPv6
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0x01,
+				0x01, 0xbb, // Port: 443
+			},
+			wantBound: "0.0.0.0:0",
+		},
+		{
+			name:     "IP literal kept as a domain",
+			target:   "192.0.2.1:443",
+			asDomain: true,
+			response: []byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+			wantOutput: []byte{
+				0x05, 0x01, 0x00, 0x03, // SOCKS5, CONNECT, reserved, domain
+				0x09, '1', '9', '2', '.', '0', '.', '2', '.', '1',
+				0x01, 0xbb, // Port: 443
+			},
+			wantBound: "0.0.0.0:0",
+		},
+		{
+			name:   "IPv6 bound address",
+			target: "example.com:80",
+			response: append([]byte{
+				0x05, 0x00, 0x00, 0x04, // Success response, IPv6
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0x01, // 2001:db8::1
+				0x04, 0x38, // Port: 1080
+			}, "tunneled data"...),
+			wantBound:    "[2001:db8::1]:1080",
+			wantTrailing: []byte("tunneled data"),
+		},
+		{
+			name:   "Domain bound address",
+			target: "example.com:80",
+			response: append([]byte{
+				0x05, 0x00, 0x00, 0x03, // Success response, domain
+				0x0d, 'p', 'r', 'o', 'x', 'y', '.', 'e', 'x', 'a', 'm', 'p', 'l', 'e',
+				0x00, 0x50, // Port: 80
+			}, "tunneled data"...),
+			wantBound:    "proxy.example:80",
+			wantTrailing: []byte("tunneled data"),
+		},
+		{
+			name:   "IPv4 bound address followed by data",
+			target: "example.com:80",
+			response: append([]byte{
+				0x05, 0x00, 0x00, 0x01,
+				127, 0, 0, 1, 0x04, 0x38,
+			}, "tunneled data"...),
+			wantBound:    "127.0.0.1:1080",
+			wantTrailing: []byte("tunneled data"),
+		},
+		{
+			name:   "Truncated IPv6 reply",
+			target: "example.com:80",
+			response: []byte{
+				0x05, 0x00, 0x00, 0x04,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0,
+			},
+			wantError: true,
+		},
+		{
+			name:   "Unknown bound address type",
+			target: "example.com:80",
+			response: []byte{
+				0x05, 0x00, 0x00, 0x07,
+				0, 0, 0, 0, 0, 0,
+			},
+			wantError: true,
+		},
+		{
+			name:   "Bad reply version",
+			target: "example.com:80",
+			response: []byte{
+				0x04, 0x5a, 0x00, 0x01,
+				0, 0, 0, 0, 0, 0,
+			},
+			wantError: true,
+		},
 		{
 			name:   "Failed connection",
 			target: "example.com:80",
@@ -351,7 +503,7 @@ func TestForwardRequest(t *testing.T) {
 				conn.AddReadData(tt.response)
 			}
 
-			err := server.forwardRequest(conn, tt.target)
+			bound, err := server.forwardRequest(conn, tt.target, tt.asDomain)
 			if (err != nil) != tt.wantError {
 				t.Errorf("forwardRequest() error = %v, wantError %v", err, tt.wantError)
 				return
@@ -363,6 +515,191 @@ func TestForwardRequest(t *testing.T) {
 					t.Errorf("forwardRequest() wrote %v, want %v", written, tt.wantOutput)
 				}
 			}
+			if bound != tt.wantBound {
+				t.Errorf("forwardRequest() bound = %q, want %q", bound, tt.wantBound)
+			}
+
+			// Nothing beyond the reply may be consumed
+			if !tt.wantError {
+				trailing, _ := io.ReadAll(conn)
+				if !bytes.Equal(trailing, tt.wantTrailing) {
+					t.Errorf("Data left after reply = %q, want %q", trailing, tt.wantTrailing)
+				}
+			}
+		})
+	}
+}
+
+// startReplyUpstream starts a mock upstream that authenticates the client
+// (if authOK) and answers every CONNECT with the given reply code and bound
+// address, echoing data afterwards on success
+func startReplyUpstream(t *testing.T, authOK bool, rep byte, bound string) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start mock upstream: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				greeting := make([]byte, 2)
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					return
+				}
+				io.ReadFull(conn, make([]byte, greeting[1]))
+				conn.Write([]byte{0x05, 0x02})
+				auth := make([]byte, 2)
+				io.ReadFull(conn, auth)
+				io.ReadFull(conn, make([]byte, auth[1]))
+				plen := make([]byte, 1)
+				io.ReadFull(conn, plen)
+				io.ReadFull(conn, make([]byte, plen[0]))
+				if !authOK {
+					conn.Write([]byte{0x01, 0x01})
+					return
+				}
+				conn.Write([]byte{0x01, 0x00})
+
+				header := make([]byte, 3)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				if _, err := readAddr(conn); err != nil {
+					return
+				}
+				addr, _ := encodeAddr(bound)
+				conn.Write(append([]byte{0x05, rep, 0x00}, addr...))
+				if rep == 0x00 {
+					io.Copy(conn, conn)
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+func TestHandleConnectReplies(t *testing.T) {
+	// A port nothing listens on, for the connection refused case
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	tests := []struct {
+		name      string
+		port      func(t *testing.T) int
+		wantReply []byte
+	}{
+		{
+			name: "Success passes bound address through",
+			port: func(t *testing.T) int {
+				return startReplyUpstream(t, true, 0x00, "10.1.2.3:4567").Addr().(*net.TCPAddr).Port
+			},
+			wantReply: []byte{0x05, 0x00, 0x00, 0x01, 10, 1, 2, 3, 0x11, 0xd7},
+		},
+		{
+			name: "Upstream host unreachable",
+			port: func(t *testing.T) int {
+				return startReplyUpstream(t, true, 0x04, "0.0.0.0:0").Addr().(*net.TCPAddr).Port
+			},
+			wantReply: []byte{0x05, 0x04, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name: "Upstream connection refused",
+			port: func(t *testing.T) int {
+				return startReplyUpstream(t, true, 0x05, "0.0.0.0:0").Addr().(*net.TCPAddr).Port
+			},
+			wantReply: []byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name: "Upstream ruleset denial",
+			port: func(t *testing.T) int {
+				return startReplyUpstream(t, true, 0x02, "0.0.0.0:0").Addr().(*net.TCPAddr).Port
+			},
+			wantReply: []byte{0x05, 0x02, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name: "Unknown upstream code",
+			port: func(t *testing.T) int {
+				return startReplyUpstream(t, true, 0x42, "0.0.0.0:0").Addr().(*net.TCPAddr).Port
+			},
+			wantReply: []byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name: "Upstream auth failure",
+			port: func(t *testing.T) int {
+				return startReplyUpstream(t, false, 0x00, "0.0.0.0:0").Addr().(*net.TCPAddr).Port
+			},
+			wantReply: []byte{0x05, 0x02, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:      "Upstream not listening",
+			port:      func(t *testing.T) int { return closedPort },
+			wantReply: []byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer(&config.Config{
+				Username:     "testuser",
+				Password:     "testpass",
+				UpstreamHost: "127.0.0.1",
+				UpstreamPort: tt.port(t),
+			})
+
+			client, proxyEnd := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer proxyEnd.Close()
+				server.handleConnect(proxyEnd, "example.com:80", true, &listener{})
+			}()
+
+			client.SetReadDeadline(time.Now().Add(2 * time.Second))
+			reply := make([]byte, len(tt.wantReply))
+			if _, err := io.ReadFull(client, reply); err != nil {
+				t.Fatalf("Failed to read reply: %v", err)
+			}
+			if !bytes.Equal(reply, tt.wantReply) {
+				t.Errorf("handleConnect() replied %v, want %v", reply, tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestReplyCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{"Upstream reply", &replyError{rep: 0x03}, 0x03},
+		{"Wrapped upstream reply", fmt.Errorf("hop 2: %w", &replyError{rep: 0x06}), 0x06},
+		{"Auth failure", errUpstreamAuth, 0x02},
+		{"Refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, 0x05},
+		{"Network unreachable", &net.OpError{Op: "dial", Err: syscall.ENETUNREACH}, 0x03},
+		{"Upstream refused", &endpointError{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, 0x01},
+		{"Upstream unreachable", &endpointError{&net.OpError{Op: "dial", Err: syscall.EHOSTUNREACH}}, 0x01},
+		{"Upstream auth failure", &endpointError{errUpstreamAuth}, 0x02},
+		{"Upstream timeout", &endpointError{&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}}, 0x06},
+		{"Timeout", &net.DNSError{Err: "timeout", IsTimeout: true}, 0x06},
+		{"DNS failure", &net.DNSError{Err: "no such host", IsNotFound: true}, 0x04},
+		{"Other", io.ErrUnexpectedEOF, 0x01},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replyCode(tt.err); got != tt.want {
+				t.Errorf("replyCode() = %#x, want %#x", got, tt.want)
+			}
 		})
 	}
 }
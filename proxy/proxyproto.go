@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-socks5-chain/config"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyV1Header is the longest v1 header, including the CRLF
+const maxProxyV1Header = 107
+
+// proxiedConn reports the client address from a PROXY protocol header as
+// its remote address
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// CloseWrite half-closes the underlying connection if it supports it
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// trustsProxyProtocol reports whether connections from addr start with a
+// PROXY protocol header
+func (s *Server) trustsProxyProtocol(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, entry := range s.config.ProxyProtocol {
+		if network, err := config.ParseNetwork(entry); err == nil && network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from conn and
+// returns conn with the client address it carries. Headers that don't carry
+// one, such as health checks, leave conn as it is.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(dialTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// Both versions are at least this long
+	start := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(conn, start); err != nil {
+		return nil, err
+	}
+
+	var remote net.Addr
+	var err error
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		remote, err = readProxyV2(conn)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		remote, err = readProxyV1(conn, start)
+	default:
+		return nil, fmt.Errorf("no PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		return conn, nil
+	}
+	return &proxiedConn{Conn: conn, remote: remote}, nil
+}
+
+// readProxyV1 reads the rest of a v1 header, "PROXY TCP4 src dst sport dport",
+// after start
+func readProxyV1(r io.Reader, start []byte) (net.Addr, error) {
+	line := append([]byte(nil), start...)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxProxyV1Header {
+			return nil, fmt.Errorf("PROXY v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the rest of a v2 header after its signature
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[0]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch header[0] & 0x0f {
+	case 0x0:
+		// LOCAL: the proxy's own connection, such as a health check
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", header[0]&0x0f)
+	}
+
+	// Only the source address matters, and TLVs after the addresses are ignored
+	switch header[1] >> 4 {
+	case 0x1:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("PROXY v2 IPv4 addresses truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x2:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("PROXY v2 IPv6 addresses truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		// AF_UNSPEC or AF_UNIX carry no usable client address
+		return nil, nil
+	}
+}
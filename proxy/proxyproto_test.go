@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go-socks5-chain/config"
+)
+
+func proxyV2Header(cmd, family byte, addrs []byte) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x20|cmd, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := append(append(net.IPv4(192, 0, 2, 10).To4(), 10, 0, 0, 1), 0xc3, 0x50, 0x04, 0x38)
+	ipv6 := append(append(net.ParseIP("2001:db8::10"), net.ParseIP("2001:db8::1")...), 0xc3, 0x50, 0x04, 0x38)
+	// A TLV after the addresses is skipped
+	ipv4TLV := append(append([]byte(nil), ipv4...), 0x04, 0x00, 0x01, 0x00)
+
+	tests := []struct {
+		name    string
+		header  []byte
+		want    string // Empty for the connection's own address
+		wantErr bool
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.10 10.0.0.1 50000 1080\r\n"), "192.0.2.10:50000", false},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::10 2001:db8::1 50000 1080\r\n"), "[2001:db8::10]:50000", false},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::10 2001:db8::1 50000 1080\r\n"), "", true},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.10 10.0.0.1 70000 1080\r\n"), "", true},
+		{"v1 too long", []byte("PROXY TCP4 " + string(make([]byte, 120)) + "\r\n"), "", true},
+		{"v2 IPv4", proxyV2Header(0x1, 0x11, ipv4), "192.0.2.10:50000", false},
+		{"v2 IPv4 with TLV", proxyV2Header(0x1, 0x11, ipv4TLV), "192.0.2.10:50000", false},
+		{"v2 IPv6", proxyV2Header(0x1, 0x21, ipv6), "[2001:db8::10]:50000", false},
+		{"v2 LOCAL", proxyV2Header(0x0, 0x00, nil), "", false},
+		{"v2 truncated", proxyV2Header(0x1, 0x11, ipv4[:8]), "", true},
+		{"no header", []byte("\x05\x01\x00 and more bytes"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go func() {
+				client.Write(tt.header)
+				client.Write([]byte("payload"))
+			}()
+
+			conn, err := readProxyHeader(server)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("readProxyHeader() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyHeader() error = %v", err)
+			}
+			want := tt.want
+			if want == "" {
+				want = server.RemoteAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != want {
+				t.Errorf("RemoteAddr() = %s, want %s", got, want)
+			}
+
+			// Whatever follows the header is left for the handler
+			buf := make([]byte, len("payload"))
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "payload" {
+				t.Errorf("Read after header = %q, %v, want payload", buf, err)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolSourceRules(t *testing.T) {
+	upstream := startRelayUpstream(t, "user", "pass")
+	echo := startEchoServer(t)
+	server := relayServer(upstream)
+	server.config.ProxyProtocol = []string{"127.0.0.0/8"}
+	server.config.Rules = []config.Rule{{Sources: []string{"192.0.2.0/24"}, Action: config.RouteReject}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	localAddr := listener.Addr().String()
+	listener.Close()
+	go server.Start(localAddr)
+	time.Sleep(100 * time.Millisecond)
+	defer server.Stop()
+
+	target, _ := encodeAddr(echo.Addr().String())
+	connect := func(header string) byte {
+		t.Helper()
+		conn, err := net.Dial("tcp", localAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to server: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte(header))
+		conn.Write([]byte{0x05, 0x01, 0x00})
+		if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+			t.Fatalf("Reading method selection: %v", err)
+		}
+		conn.Write(append([]byte{0x05, 0x01, 0x00}, target...))
+		rep, _, err := readReply(conn)
+		if err != nil {
+			t.Fatalf("readReply() error = %v", err)
+		}
+		return rep
+	}
+
+	// Rules see the client from the header, not the load balancer
+	if rep := connect("PROXY TCP4 192.0.2.10 127.0.0.1 50000 1080\r\n"); rep != repNotAllowed {
+		t.Errorf("Reply for a rejected client = %d, want %d", rep, repNotAllowed)
+	}
+	if rep := connect("PROXY TCP4 198.51.100.10 127.0.0.1 50000 1080\r\n"); rep != repSuccess {
+		t.Errorf("Reply for an allowed client = %d, want success", rep)
+	}
+
+	// Trusted sources must send a header
+	conn, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write(append([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00}, target...))
+	if _, err := conn.Read(make([]byte, 2)); err == nil {
+		t.Error("Read() succeeded, want a connection without header closed")
+	}
+}
+
+func TestTrustsProxyProtocol(t *testing.T) {
+	server := NewServer(&config.Config{ProxyProtocol: []string{"10.0.0.0/8", "192.0.2.1"}})
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 40000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 40000}, false},
+		{&net.UnixAddr{Name: "/tmp/socket", Net: "unix"}, false},
+	}
+	for _, tt := range tests {
+		if got := server.trustsProxyProtocol(tt.addr); got != tt.want {
+			t.Errorf("trustsProxyProtocol(%v) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
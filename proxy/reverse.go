@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	// Delay before re-arming a reverse tunnel whose BIND failed, doubled on
+	// every further failure
+	minReverseRetry = time.Second
+	maxReverseRetry = time.Minute
+)
+
+// startReverse keeps a reverse tunnel armed for every configured target
+// until the server stops
+func (s *Server) startReverse() error {
+	if len(s.config.Reverse) > 0 && !s.lastHop().IsSOCKS5() {
+		return fmt.Errorf("reverse tunnels need a SOCKS5 last upstream hop, not %s", s.lastHop().Type)
+	}
+	for _, target := range s.config.Reverse {
+		s.wg.Add(1)
+		go s.runReverse(target)
+	}
+	return nil
+}
+
+// runReverse arms a BIND on the last upstream hop for target, and arms it
+// again whenever it fails or its peer disconnects
+func (s *Server) runReverse(target string) {
+	defer s.wg.Done()
+
+	retry := minReverseRetry
+	for s.ctx.Err() == nil {
+		err := s.serveReverse(target)
+		if s.ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			retry = minReverseRetry
+			continue
+		}
+
+		log.Printf("Reverse tunnel to %s failed, re-arming in %v: %v", target, retry, err)
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, maxReverseRetry)
+	}
+}
+
+// serveReverse issues one BIND through the chain, waits for a peer to
+// connect to the bound address and splices it with a new connection to
+// target. It returns once the peer is gone.
+func (s *Server) serveReverse(target string) error {
+	upstreamConn, err := s.connectToUpstream(nil)
+	if err != nil {
+		return err
+	}
+	defer upstreamConn.Close()
+
+	// Waiting for the peer can take a while, so don't hold up shutdown
+	stop := context.AfterFunc(s.ctx, func() { upstreamConn.Close() })
+	defer stop()
+
+	addr, _ := encodeAddr(unspecifiedAddr)
+	if _, err := upstreamConn.Write(append([]byte{VERSION, cmdBind, 0x00}, addr...)); err != nil {
+		return fmt.Errorf("failed to send BIND request: %v", err)
+	}
+
+	// First reply: the address the upstream is listening on
+	rep, bound, err := readReply(upstreamConn)
+	if err != nil {
+		return fmt.Errorf("failed to read BIND reply: %v", err)
+	}
+	if rep != repSuccess {
+		return &replyError{rep: rep}
+	}
+	log.Printf("Reverse tunnel to %s listening on %s", target, bound)
+
+	// Second reply: the peer that connected
+	rep, peer, err := readReply(upstreamConn)
+	if err != nil {
+		return fmt.Errorf("bind on %s ended: %v", bound, err)
+	}
+	if rep != repSuccess {
+		return &replyError{rep: rep}
+	}
+
+	localConn, err := net.DialTimeout("tcp", target, dialTimeout)
+	if err != nil {
+		return fmt.Errorf("peer %s connected, but %s is unreachable: %v", peer, target, err)
+	}
+	defer localConn.Close()
+	stop()
+
+	log.Printf("Reverse tunnel peer %s connected to %s", peer, target)
+	s.forwardTraffic(upstreamConn, localConn)
+	log.Printf("Reverse tunnel peer %s disconnected from %s", peer, target)
+	return nil
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"go-socks5-chain/config"
+)
+
+func TestReverseTunnel(t *testing.T) {
+	echo := startEchoServer(t)
+	boundAddrs := make(chan string, 1)
+	upstream := startNotifyingBindUpstream(t, boundAddrs)
+
+	server := NewServer(&config.Config{
+		Username:     "testuser",
+		Password:     "testpass",
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Addr().(*net.TCPAddr).Port,
+		Reverse:      []string{echo.Addr().String()},
+	})
+	if err := server.startReverse(); err != nil {
+		t.Fatalf("startReverse() error = %v", err)
+	}
+	defer server.Stop()
+
+	// The BIND is armed again after every peer disconnects
+	for i := 0; i < 2; i++ {
+		var bound string
+		select {
+		case bound = <-boundAddrs:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Reverse tunnel %d was not armed", i)
+		}
+		peer, err := net.Dial("tcp", bound)
+		if err != nil {
+			t.Fatalf("Dialing bound address %s: %v", bound, err)
+		}
+		echoThrough(t, peer, "reversed")
+		peer.Close()
+	}
+}
+
+func TestReverseTunnelNeedsSOCKS5(t *testing.T) {
+	server := NewServer(&config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 8080,
+		UpstreamType: config.HopTypeHTTP,
+		Reverse:      []string{"127.0.0.1:8000"},
+	})
+	if err := server.startReverse(); err == nil {
+		t.Error("startReverse() succeeded with an HTTP upstream")
+	}
+}
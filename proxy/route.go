@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"go-socks5-chain/config"
+)
+
+// route returns the first routing rule matching a connection from the
+// client at source, accepted by the listener with the given ID, to target,
+// or an upstream rule if none does
+func (s *Server) route(listener string, source net.Addr, target string) config.Rule {
+	host, portStr, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(portStr)
+	var sourceIP net.IP
+	if source != nil {
+		if ip, _, err := net.SplitHostPort(source.String()); err == nil {
+			sourceIP = net.ParseIP(ip)
+		}
+	}
+
+	for _, rule := range s.config.Rules {
+		if rule.Match(listener, sourceIP, host, port) {
+			return rule
+		}
+	}
+	return config.Rule{Action: config.RouteUpstream}
+}
+
+// dialTarget connects to target on behalf of the client at source, which
+// came through the listener with the given ID, the way the routing rules
+// say, and returns the connection along with the bound address reported by
+// the last hop or, for direct connections, our own. domain tells whether the
+// client sent the target's host as a domain name.
+func (s *Server) dialTarget(listener string, source net.Addr, target string, domain bool) (net.Conn, string, error) {
+	rule := s.route(listener, source, target)
+	switch rule.Action {
+	case config.RouteReject:
+		return nil, "", errRejected
+	case config.RouteDirect:
+		conn, err := net.DialTimeout("tcp", target, dialTimeout)
+		if err != nil {
+			return nil, "", err
+		}
+		return conn, conn.LocalAddr().String(), nil
+	}
+
+	asDomain := false
+	switch s.config.Resolve {
+	case config.ResolveLocal:
+		resolved, err := s.resolveTarget(target)
+		if err != nil {
+			return nil, "", err
+		}
+		target = resolved
+	case config.ResolvePreserve:
+		asDomain = domain
+	}
+
+	if rule.Action == config.RouteChain {
+		return s.dialChain(s.config.Chains[rule.Chain], target, asDomain)
+	}
+	return s.dialUpstream(source, target, asDomain)
+}
+
+// resolveTarget resolves the host of target to an address, preferring IPv4.
+// IP literals are returned unchanged.
+func (s *Server) resolveTarget(target string) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || net.ParseIP(host) != nil {
+		return target, err
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, dialTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	ip := addrs[0].IP
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			ip = addr.IP
+			break
+		}
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
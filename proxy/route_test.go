@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"go-socks5-chain/config"
+)
+
+func TestDialTargetRouting(t *testing.T) {
+	upstream := startRelayUpstream(t, "user", "pass")
+	alternate := startRelayUpstream(t, "", "")
+	viaUpstream, direct, viaChain := startEchoServer(t), startEchoServer(t), startEchoServer(t)
+	port := func(l net.Listener) string { return strconv.Itoa(l.Addr().(*net.TCPAddr).Port) }
+
+	server := relayServer(upstream)
+	server.config.Chains = map[string][]config.Hop{"alt": {alternate.hop()}}
+	server.config.Rules = []config.Rule{
+		{Ports: []string{port(direct)}, Action: config.RouteDirect},
+		{Ports: []string{port(viaChain)}, Action: config.RouteChain, Chain: "alt"},
+		{Domains: []string{"blocked.example.com"}, Action: config.RouteReject},
+		{Sources: []string{"192.0.2.0/24"}, Action: config.RouteReject},
+	}
+
+	for _, l := range []net.Listener{viaUpstream, direct, viaChain} {
+		conn, _, err := server.dialTarget("", nil, l.Addr().String(), false)
+		if err != nil {
+			t.Fatalf("dialTarget(%s) error = %v", l.Addr(), err)
+		}
+		echoThrough(t, conn, "routed")
+		conn.Close()
+	}
+	if got := upstream.requestedTargets(); len(got) != 1 || got[0] != viaUpstream.Addr().String() {
+		t.Errorf("Upstream targets = %v, want only %s", got, viaUpstream.Addr())
+	}
+	if got := alternate.requestedTargets(); len(got) != 1 || got[0] != viaChain.Addr().String() {
+		t.Errorf("Alternate chain targets = %v, want only %s", got, viaChain.Addr())
+	}
+
+	blockedClient := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 50000}
+	for _, tt := range []struct {
+		source net.Addr
+		target string
+	}{
+		{nil, "blocked.example.com:443"},
+		{nil, "www.blocked.example.com:80"},
+		{blockedClient, viaUpstream.Addr().String()},
+	} {
+		_, _, err := server.dialTarget("", tt.source, tt.target, false)
+		if !errors.Is(err, errRejected) {
+			t.Errorf("dialTarget(%v, %s) error = %v, want a rejection", tt.source, tt.target, err)
+		}
+	}
+	if got := len(upstream.requestedTargets()); got != 1 {
+		t.Errorf("Upstream got %d requests, want rejected ones not to reach it", got)
+	}
+}
+
+func TestRejectedSOCKS5Connect(t *testing.T) {
+	upstream := startRelayUpstream(t, "user", "pass")
+	server := relayServer(upstream)
+	server.config.Rules = []config.Rule{{Ports: []string{"25"}, Action: config.RouteReject}}
+	client := serveHTTPClient(t, server)
+
+	client.Write([]byte{0x05, 0x01, 0x00})
+	if _, err := io.ReadFull(client, make([]byte, 2)); err != nil {
+		t.Fatalf("Reading method selection: %v", err)
+	}
+	client.Write([]byte{0x05, 0x01, 0x00, 0x03, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x00, 25})
+	rep, _, err := readReply(client)
+	if err != nil {
+		t.Fatalf("readReply() error = %v", err)
+	}
+	if rep != repNotAllowed {
+		t.Errorf("Reply = %d, want %d (not allowed by ruleset)", rep, repNotAllowed)
+	}
+	if got := upstream.requestedTargets(); len(got) != 0 {
+		t.Errorf("Upstream was asked for %v, want nothing", got)
+	}
+}
+
+func TestResolutionModes(t *testing.T) {
+	echo := startEchoServer(t)
+	port := strconv.Itoa(echo.Addr().(*net.TCPAddr).Port)
+
+	tests := []struct {
+		mode       string
+		target     string
+		domain     bool
+		wantTarget string
+		wantType   byte
+	}{
+		{config.ResolveRemote, "localhost:" + port, true, "localhost:" + port, atypDomain},
+		{config.ResolveLocal, "localhost:" + port, true, "127.0.0.1:" + port, atypIPv4},
+		{config.ResolvePreserve, "localhost:" + port, true, "localhost:" + port, atypDomain},
+		// IP literals are sent as addresses unless the client sent them as a name
+		{config.ResolveRemote, "127.0.0.1:" + port, true, "127.0.0.1:" + port, atypIPv4},
+		{config.ResolvePreserve, "127.0.0.1:" + port, false, "127.0.0.1:" + port, atypIPv4},
+		{config.ResolvePreserve, "127.0.0.1:" + port, true, "127.0.0.1:" + port, atypDomain},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.target, func(t *testing.T) {
+			upstream := startRelayUpstream(t, "user", "pass")
+			server := relayServer(upstream)
+			server.config.Resolve = tt.mode
+
+			conn, _, err := server.dialTarget("", nil, tt.target, tt.domain)
+			if err != nil {
+				t.Fatalf("dialTarget() error = %v", err)
+			}
+			echoThrough(t, conn, "resolved")
+			conn.Close()
+
+			if got := upstream.requestedTargets(); len(got) != 1 || got[0] != tt.wantTarget {
+				t.Errorf("Upstream targets = %v, want [%s]", got, tt.wantTarget)
+			}
+			if got := upstream.requestedAddrTypes(); len(got) != 1 || got[0] != tt.wantType {
+				t.Errorf("Upstream address types = %v, want [%d]", got, tt.wantType)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+)
+
+const (
+	socks4Version = 0x04
+
+	// SOCKS4 reply codes
+	socks4Granted  = 90
+	socks4Rejected = 91
+
+	// maxSOCKS4Field bounds the null-terminated USERID and domain fields
+	maxSOCKS4Field = 255
+)
+
+// socks4Request is a parsed SOCKS4 or SOCKS4a request
+type socks4Request struct {
+	cmd    byte
+	target string
+	userID string
+	domain bool // SOCKS4a: the target is a domain name
+}
+
+// handleSOCKS4 serves a SOCKS4/4a client. Only CONNECT is supported; the
+// request is forwarded through the same SOCKS5 upstream chain.
+func (s *Server) handleSOCKS4(client net.Conn, l *listener) {
+	req, err := readSOCKS4Request(client)
+	if err != nil {
+		log.Printf("SOCKS4 request handling failed: %v", err)
+		return
+	}
+
+	// SOCKS4 has no way to carry a password
+	if s.authRequired(l) {
+		log.Printf("Rejecting SOCKS4 client %s: local authentication is required", client.RemoteAddr())
+		sendSOCKS4Reply(client, socks4Rejected, "")
+		return
+	}
+
+	if req.cmd != cmdConnect {
+		log.Printf("Unsupported SOCKS4 command %d from %s", req.cmd, client.RemoteAddr())
+		sendSOCKS4Reply(client, socks4Rejected, "")
+		return
+	}
+
+	if req.userID != "" {
+		log.Printf("SOCKS4 CONNECT to %s from %s (user ID %q)", req.target, client.RemoteAddr(), req.userID)
+	}
+
+	upstreamConn, bound, err := s.dialTarget(l.id, client.RemoteAddr(), req.target, req.domain)
+	if err != nil {
+		log.Printf("Failed to connect to %s through upstream: %v", req.target, err)
+		sendSOCKS4Reply(client, socks4Rejected, "")
+		return
+	}
+	defer upstreamConn.Close()
+
+	if err := sendSOCKS4Reply(client, socks4Granted, bound); err != nil {
+		return
+	}
+
+	s.forwardTraffic(client, upstreamConn)
+}
+
+// readSOCKS4Request parses a SOCKS4 request, including the SOCKS4a form
+// where DSTIP is 0.0.0.x and a domain name follows the USERID
+func readSOCKS4Request(r io.Reader) (*socks4Request, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socks4Version {
+		return nil, fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+
+	port := binary.BigEndian.Uint16(header[2:4])
+	ip := net.IP(header[4:8])
+
+	userID, err := readNullTerminated(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user ID: %v", err)
+	}
+
+	host := ip.String()
+	domain := ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0
+	if domain {
+		// SOCKS4a: the server resolves the name
+		host, err = readNullTerminated(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read domain name: %v", err)
+		}
+		if host == "" {
+			return nil, fmt.Errorf("empty SOCKS4a domain name")
+		}
+	}
+
+	return &socks4Request{
+		cmd:    header[1],
+		target: net.JoinHostPort(host, strconv.Itoa(int(port))),
+		userID: userID,
+		domain: domain,
+	}, nil
+}
+
+// readNullTerminated reads a null-terminated string of at most
+// maxSOCKS4Field bytes
+func readNullTerminated(r io.Reader) (string, error) {
+	var buf bytes.Buffer
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return buf.String(), nil
+		}
+		if buf.Len() >= maxSOCKS4Field {
+			return "", fmt.Errorf("field longer than %d bytes", maxSOCKS4Field)
+		}
+		buf.WriteByte(b[0])
+	}
+}
+
+// sendSOCKS4Reply writes a SOCKS4 reply. The bound address is only included
+// when it is an IPv4 address, as SOCKS4 can't represent anything else.
+func sendSOCKS4Reply(conn net.Conn, code byte, bound string) error {
+	reply := make([]byte, 8)
+	reply[1] = code
+	if host, port, err := net.SplitHostPort(bound); err == nil {
+		if ip := net.ParseIP(host).To4(); ip != nil {
+			portNum, _ := strconv.Atoi(port)
+			binary.BigEndian.PutUint16(reply[2:4], uint16(portNum))
+			copy(reply[4:8], ip)
+		}
+	}
+	_, err := conn.Write(reply)
+	return err
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go-socks5-chain/config"
+)
+
+// rawSOCKS4Request builds a raw SOCKS4 request; a non-empty domain produces
+// the SOCKS4a form
+func rawSOCKS4Request(cmd byte, ip net.IP, port uint16, userID, domain string) []byte {
+	req := []byte{0x04, cmd, 0, 0}
+	binary.BigEndian.PutUint16(req[2:4], port)
+	req = append(req, ip.To4()...)
+	req = append(req, []byte(userID)...)
+	req = append(req, 0)
+	if domain != "" {
+		req = append(req, []byte(domain)...)
+		req = append(req, 0)
+	}
+	return req
+}
+
+func TestReadSOCKS4Request(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      []byte
+		wantCmd    byte
+		wantTarget string
+		wantUserID string
+		wantErr    bool
+	}{
+		{
+			name:       "SOCKS4 IPv4 target",
+			input:      rawSOCKS4Request(0x01, net.IPv4(192, 168, 1, 1), 80, "", ""),
+			wantCmd:    0x01,
+			wantTarget: "192.168.1.1:80",
+		},
+		{
+			name:       "SOCKS4 with user ID",
+			input:      rawSOCKS4Request(0x01, net.IPv4(10, 0, 0, 1), 443, "alice", ""),
+			wantCmd:    0x01,
+			wantTarget: "10.0.0.1:443",
+			wantUserID: "alice",
+		},
+		{
+			name:       "SOCKS4a domain target",
+			input:      rawSOCKS4Request(0x01, net.IPv4(0, 0, 0, 1), 8080, "bob", "example.com"),
+			wantCmd:    0x01,
+			wantTarget: "example.com:8080",
+			wantUserID: "bob",
+		},
+		{
+			name:       "BIND command",
+			input:      rawSOCKS4Request(0x02, net.IPv4(10, 0, 0, 1), 21, "", ""),
+			wantCmd:    0x02,
+			wantTarget: "10.0.0.1:21",
+		},
+		{
+			name:    "Empty SOCKS4a domain",
+			input:   rawSOCKS4Request(0x01, net.IPv4(0, 0, 0, 1), 80, "", "\x00"),
+			wantErr: true,
+		},
+		{
+			name:    "Truncated header",
+			input:   []byte{0x04, 0x01, 0x00},
+			wantErr: true,
+		},
+		{
+			name:    "Missing user ID terminator",
+			input:   []byte{0x04, 0x01, 0x00, 0x50, 10, 0, 0, 1, 'a'},
+			wantErr: true,
+		},
+		{
+			name:    "User ID too long",
+			input:   rawSOCKS4Request(0x01, net.IPv4(10, 0, 0, 1), 80, string(bytes.Repeat([]byte("a"), 256)), ""),
+			wantErr: true,
+		},
+		{
+			name:    "Wrong version",
+			input:   []byte{0x05, 0x01, 0x00, 0x50, 10, 0, 0, 1, 0x00},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := readSOCKS4Request(bytes.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readSOCKS4Request() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if req.cmd != tt.wantCmd || req.target != tt.wantTarget || req.userID != tt.wantUserID {
+				t.Errorf("readSOCKS4Request() = %+v, want cmd %d target %q user ID %q",
+					req, tt.wantCmd, tt.wantTarget, tt.wantUserID)
+			}
+		})
+	}
+}
+
+func TestSOCKS4Integration(t *testing.T) {
+	echo := startEchoServer(t)
+	echoPort := uint16(echo.Addr().(*net.TCPAddr).Port)
+	upstream := startRelayUpstream(t, "user", "pass")
+	hop := upstream.hop()
+
+	tests := []struct {
+		name      string
+		request   []byte
+		localAuth bool
+		wantCode  byte
+	}{
+		{
+			name:     "SOCKS4 connect",
+			request:  rawSOCKS4Request(0x01, net.IPv4(127, 0, 0, 1), echoPort, "", ""),
+			wantCode: socks4Granted,
+		},
+		{
+			name:     "SOCKS4a connect",
+			request:  rawSOCKS4Request(0x01, net.IPv4(0, 0, 0, 1), echoPort, "alice", "localhost"),
+			wantCode: socks4Granted,
+		},
+		{
+			name:     "BIND rejected",
+			request:  rawSOCKS4Request(0x02, net.IPv4(127, 0, 0, 1), echoPort, "", ""),
+			wantCode: socks4Rejected,
+		},
+		{
+			name:      "Rejected when local auth is required",
+			request:   rawSOCKS4Request(0x01, net.IPv4(127, 0, 0, 1), echoPort, "", ""),
+			localAuth: true,
+			wantCode:  socks4Rejected,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Username:     hop.Username,
+				Password:     hop.Password,
+				UpstreamHost: hop.Host,
+				UpstreamPort: hop.Port,
+			}
+			if tt.localAuth {
+				cfg.LocalUsers = map[string]string{"alice": "unused"}
+			}
+			server := NewServer(cfg)
+
+			client, proxyEnd := net.Pipe()
+			defer client.Close()
+			server.wg.Add(1)
+			go server.handleConnection(proxyEnd, &listener{})
+
+			client.SetDeadline(time.Now().Add(2 * time.Second))
+			if _, err := client.Write(tt.request); err != nil {
+				t.Fatalf("Failed to write request: %v", err)
+			}
+			reply := make([]byte, 8)
+			if _, err := io.ReadFull(client, reply); err != nil {
+				t.Fatalf("Failed to read reply: %v", err)
+			}
+			if reply[0] != 0x00 || reply[1] != tt.wantCode {
+				t.Fatalf("Reply = %v, want code %d", reply, tt.wantCode)
+			}
+			if tt.wantCode != socks4Granted {
+				return
+			}
+
+			msg := []byte("hello over socks4")
+			if _, err := client.Write(msg); err != nil {
+				t.Fatalf("Failed to write data: %v", err)
+			}
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(client, got); err != nil {
+				t.Fatalf("Failed to read echoed data: %v", err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Errorf("Echoed %q, want %q", got, msg)
+			}
+		})
+	}
+}
+
+func TestSendSOCKS4Reply(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  byte
+		bound string
+		want  []byte
+	}{
+		{"IPv4 bound address", socks4Granted, "10.1.2.3:4567", []byte{0x00, 90, 0x11, 0xd7, 10, 1, 2, 3}},
+		{"IPv6 bound address is omitted", socks4Granted, "[2001:db8::1]:80", []byte{0x00, 90, 0, 0, 0, 0, 0, 0}},
+		{"Rejected without address", socks4Rejected, "", []byte{0x00, 91, 0, 0, 0, 0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := NewMockConn()
+			if err := sendSOCKS4Reply(conn, tt.code, tt.bound); err != nil {
+				t.Fatalf("sendSOCKS4Reply() error = %v", err)
+			}
+			if got := conn.GetWrittenData(); !bytes.Equal(got, tt.want) {
+				t.Errorf("sendSOCKS4Reply() wrote %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go-socks5-chain/config"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// errSSHSessionLost is returned when a shared SSH session turns out to be dead
+var errSSHSessionLost = errors.New("SSH session lost")
+
+// sshSessions keeps one SSH session per SSH hop so that every client
+// connection through the hop is a channel on the same session. Sessions are
+// keyed by the hops used to reach them.
+type sshSessions struct {
+	mu      sync.Mutex
+	clients map[string]*ssh.Client
+	closed  bool
+}
+
+func newSSHSessions() *sshSessions {
+	return &sshSessions{clients: make(map[string]*ssh.Client)}
+}
+
+// sessionKey identifies the SSH hop at the end of hops by its path
+func sessionKey(hops []config.Hop) string {
+	parts := make([]string, len(hops))
+	for i, hop := range hops {
+		parts[i] = hop.Username + "@" + hop.Addr()
+	}
+	return strings.Join(parts, ">")
+}
+
+// resume returns the index of the furthest SSH hop in hops that has an open
+// session, along with the session. It returns 0 and nil if there is none.
+func (p *sshSessions) resume(hops []config.Hop) (int, *ssh.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !hops[i].IsSSH() {
+			continue
+		}
+		if client := p.clients[sessionKey(hops[:i+1])]; client != nil {
+			return i, client
+		}
+	}
+	return 0, nil
+}
+
+// open starts an SSH session over conn with the last of hops. If another
+// connection opened a session for the same hop meanwhile, that one is used.
+func (p *sshSessions) open(conn net.Conn, hops []config.Hop) (*ssh.Client, error) {
+	hop := hops[len(hops)-1]
+	cfg, err := sshClientConfig(hop)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, hop.Addr(), cfg)
+	if err != nil {
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, fmt.Errorf("%w: %v", errUpstreamAuth, err)
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(c, chans, reqs)
+
+	key := sessionKey(hops)
+	p.mu.Lock()
+	if existing := p.clients[key]; existing != nil {
+		p.mu.Unlock()
+		client.Close()
+		return existing, nil
+	}
+	if !p.closed {
+		p.clients[key] = client
+	}
+	p.mu.Unlock()
+
+	go func() {
+		client.Wait()
+		p.forget(key, client)
+	}()
+	return client, nil
+}
+
+// dial opens a direct-tcpip channel to addr on the session with the last of
+// hops. A session that fails for any reason other than the server refusing
+// the channel is dropped and errSSHSessionLost is returned.
+func (p *sshSessions) dial(client *ssh.Client, hops []config.Hop, addr string) (net.Conn, error) {
+	conn, err := client.Dial("tcp", addr)
+	if err == nil {
+		return conn, nil
+	}
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		return nil, err
+	}
+	p.forget(sessionKey(hops), client)
+	client.Close()
+	return nil, fmt.Errorf("%w: %v", errSSHSessionLost, err)
+}
+
+// forget removes client from the cache if it is still the session for key
+func (p *sshSessions) forget(key string, client *ssh.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.clients[key] == client {
+		delete(p.clients, key)
+	}
+}
+
+// closeAll closes every session and stops caching new ones
+func (p *sshSessions) closeAll() {
+	p.mu.Lock()
+	clients := p.clients
+	p.clients = make(map[string]*ssh.Client)
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, client := range clients {
+		client.Close()
+	}
+}
+
+// sshClientConfig builds the client configuration for an SSH hop. Host keys
+// are always verified against the hop's known_hosts file.
+func sshClientConfig(hop config.Hop) (*ssh.ClientConfig, error) {
+	knownHostsFile := hop.KnownHosts
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known hosts: %w", err)
+	}
+
+	var auth []ssh.AuthMethod
+	usePassword := hop.Password != ""
+	if hop.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(hop.PrivateKey))
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			// The password is the key's passphrase
+			signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(hop.PrivateKey), []byte(hop.Password))
+			usePassword = false
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH private key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if usePassword {
+		auth = append(auth, ssh.Password(hop.Password))
+	}
+
+	return &ssh.ClientConfig{
+		User:            hop.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         dialTimeout,
+	}, nil
+}
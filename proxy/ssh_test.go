@@ -0,0 +1,349 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"go-socks5-chain/config"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshUpstream is a minimal SSH server that accepts direct-tcpip channels and
+// really connects them to the requested address
+type sshUpstream struct {
+	listener   net.Listener
+	knownHosts string
+
+	mu       sync.Mutex
+	sessions int
+}
+
+// startSSHUpstream starts an SSH server accepting user/password and, if
+// clientKey is non-nil, that public key. Its host key is written to a
+// known_hosts file for the tests to use.
+func startSSHUpstream(t *testing.T, user, password string, clientKey ssh.PublicKey) *sshUpstream {
+	t.Helper()
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %v", err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatalf("Failed to create host signer: %v", err)
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == user && string(pass) == password {
+				return nil, nil
+			}
+			return nil, errUpstreamAuth
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if clientKey != nil && c.User() == user && bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errUpstreamAuth
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start SSH upstream: %v", err)
+	}
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, hostSigner.PublicKey())
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+
+	u := &sshUpstream{listener: listener, knownHosts: knownHosts}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go u.handle(conn, serverConfig)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return u
+}
+
+func (u *sshUpstream) hop(user, password string) config.Hop {
+	addr := u.listener.Addr().(*net.TCPAddr)
+	return config.Hop{
+		Host:       "127.0.0.1",
+		Port:       addr.Port,
+		Username:   user,
+		Password:   password,
+		Type:       config.HopTypeSSH,
+		KnownHosts: u.knownHosts,
+	}
+}
+
+func (u *sshUpstream) sessionCount() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.sessions
+}
+
+func (u *sshUpstream) handle(conn net.Conn, cfg *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	u.mu.Lock()
+	u.sessions++
+	u.mu.Unlock()
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		// RFC 4254 section 7.2: host, port, originator host, originator port
+		data := newChannel.ExtraData()
+		hostLen := binary.BigEndian.Uint32(data)
+		host := string(data[4 : 4+hostLen])
+		port := binary.BigEndian.Uint32(data[4+hostLen:])
+
+		target, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))), 2*time.Second)
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, chReqs, err := newChannel.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		go ssh.DiscardRequests(chReqs)
+		go func() {
+			defer channel.Close()
+			defer target.Close()
+			go io.Copy(target, channel)
+			io.Copy(channel, target)
+		}()
+	}
+}
+
+// echoThrough checks that conn is connected to an echo server
+func echoThrough(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if string(got) != msg {
+		t.Errorf("Echoed %q, want %q", got, msg)
+	}
+}
+
+func sshServer(hop config.Hop, chain ...config.Hop) *Server {
+	return NewServer(&config.Config{
+		Username:     hop.Username,
+		Password:     hop.Password,
+		UpstreamHost: hop.Host,
+		UpstreamPort: hop.Port,
+		UpstreamType: config.HopTypeSSH,
+		PrivateKey:   hop.PrivateKey,
+		KnownHosts:   hop.KnownHosts,
+		Chain:        chain,
+	})
+}
+
+func TestSSHUpstreamSharesSession(t *testing.T) {
+	echo := startEchoServer(t)
+	upstream := startSSHUpstream(t, "jump", "jumppass", nil)
+	server := sshServer(upstream.hop("jump", "jumppass"))
+	defer server.sshSessions.closeAll()
+
+	for i := 0; i < 3; i++ {
+		conn, bound, err := server.dialTarget("", nil, echo.Addr().String(), false)
+		if err != nil {
+			t.Fatalf("dialTarget() error = %v", err)
+		}
+		if bound != "" {
+			t.Errorf("dialTarget() bound = %q, want none from an SSH hop", bound)
+		}
+		echoThrough(t, conn, "hello over ssh")
+		conn.Close()
+	}
+
+	if got := upstream.sessionCount(); got != 1 {
+		t.Errorf("SSH upstream saw %d sessions, want 1 shared session", got)
+	}
+}
+
+func TestSSHUpstreamThenSOCKS5Hop(t *testing.T) {
+	echo := startEchoServer(t)
+	upstream := startSSHUpstream(t, "jump", "jumppass", nil)
+	relay := startRelayUpstream(t, "user", "pass")
+	server := sshServer(upstream.hop("jump", "jumppass"), relay.hop())
+	defer server.sshSessions.closeAll()
+
+	conn, _, err := server.dialTarget("", nil, echo.Addr().String(), false)
+	if err != nil {
+		t.Fatalf("dialTarget() error = %v", err)
+	}
+	defer conn.Close()
+	echoThrough(t, conn, "ssh then socks5")
+
+	if targets := relay.requestedTargets(); len(targets) != 1 || targets[0] != echo.Addr().String() {
+		t.Errorf("SOCKS5 hop was asked for %v, want [%s]", targets, echo.Addr())
+	}
+}
+
+func TestSSHUpstreamPrivateKey(t *testing.T) {
+	echo := startEchoServer(t)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate client key: %v", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("Failed to convert client key: %v", err)
+	}
+	upstream := startSSHUpstream(t, "deploy", "unused-password", sshPub)
+
+	tests := []struct {
+		name       string
+		passphrase string
+	}{
+		{name: "Plain key"},
+		{name: "Encrypted key", passphrase: "keypass"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var block *pem.Block
+			if tt.passphrase != "" {
+				block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte(tt.passphrase))
+			} else {
+				block, err = ssh.MarshalPrivateKey(priv, "")
+			}
+			if err != nil {
+				t.Fatalf("Failed to marshal client key: %v", err)
+			}
+
+			hop := upstream.hop("deploy", tt.passphrase)
+			hop.PrivateKey = string(pem.EncodeToMemory(block))
+			server := sshServer(hop)
+			defer server.sshSessions.closeAll()
+
+			conn, _, err := server.dialTarget("", nil, echo.Addr().String(), false)
+			if err != nil {
+				t.Fatalf("dialTarget() error = %v", err)
+			}
+			defer conn.Close()
+			echoThrough(t, conn, "key auth")
+		})
+	}
+}
+
+func TestSSHUpstreamFailures(t *testing.T) {
+	upstream := startSSHUpstream(t, "jump", "jumppass", nil)
+	other := startSSHUpstream(t, "jump", "jumppass", nil)
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		hop     config.Hop
+		target  string
+		wantRep byte
+	}{
+		{
+			name:    "Wrong password",
+			hop:     upstream.hop("jump", "wrong"),
+			target:  "127.0.0.1:80",
+			wantRep: repNotAllowed,
+		},
+		{
+			name: "Unknown host key",
+			hop: func() config.Hop {
+				hop := upstream.hop("jump", "jumppass")
+				hop.KnownHosts = other.knownHosts
+				return hop
+			}(),
+			target:  "127.0.0.1:80",
+			wantRep: repGeneralFailure,
+		},
+		{
+			name:    "Target refused",
+			hop:     upstream.hop("jump", "jumppass"),
+			target:  closedAddr,
+			wantRep: repHostUnreachable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := sshServer(tt.hop)
+			defer server.sshSessions.closeAll()
+
+			conn, _, err := server.dialTarget("", nil, tt.target, false)
+			if err == nil {
+				conn.Close()
+				t.Fatal("dialTarget() succeeded, want an error")
+			}
+			if got := replyCode(err); got != tt.wantRep {
+				t.Errorf("replyCode(%v) = %d, want %d", err, got, tt.wantRep)
+			}
+		})
+	}
+}
+
+func TestSSHUpstreamReconnectsLostSession(t *testing.T) {
+	echo := startEchoServer(t)
+	upstream := startSSHUpstream(t, "jump", "jumppass", nil)
+	server := sshServer(upstream.hop("jump", "jumppass"))
+	defer server.sshSessions.closeAll()
+
+	conn, _, err := server.dialTarget("", nil, echo.Addr().String(), false)
+	if err != nil {
+		t.Fatalf("dialTarget() error = %v", err)
+	}
+	conn.Close()
+
+	// Break the cached session behind the cache's back
+	_, session := server.sshSessions.resume(server.config.Hops())
+	if session == nil {
+		t.Fatal("No cached SSH session after the first connection")
+	}
+	session.Conn.Close()
+
+	conn, _, err = server.dialTarget("", nil, echo.Addr().String(), false)
+	if err != nil {
+		t.Fatalf("dialTarget() after losing the session error = %v", err)
+	}
+	defer conn.Close()
+	echoThrough(t, conn, "reconnected")
+}
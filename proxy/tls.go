@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"go-socks5-chain/config"
+)
+
+// errPinMismatch is returned when no certificate matches a configured pin
+var errPinMismatch = errors.New("no certificate matches the configured pins")
+
+// hopTLSConfig builds the TLS client configuration for a hop from its
+// TLSOptions
+func hopTLSConfig(hop config.Hop) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: hop.Host}
+	opts := hop.TLSOptions
+	if opts == nil {
+		return cfg, nil
+	}
+
+	if opts.ServerName != "" {
+		cfg.ServerName = opts.ServerName
+	}
+
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		certFile, err := config.ResolvePath(opts.CertFile)
+		if err != nil {
+			return nil, err
+		}
+		keyFile, err := config.ResolvePath(opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(opts.Pins) > 0 {
+		pins, err := parsePins(opts.Pins)
+		if err != nil {
+			return nil, err
+		}
+		if opts.CAFile == "" {
+			// The pins alone decide whether the hop's certificate is trusted
+			cfg.InsecureSkipVerify = true
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		}
+	}
+
+	return cfg, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(name string) (*x509.CertPool, error) {
+	path, err := config.ResolvePath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+// parsePins decodes SPKI pins given as base64 SHA-256 hashes
+func parsePins(pins []string) ([][]byte, error) {
+	var hashes [][]byte
+	for _, pin := range pins {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q", pin)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// spkiHash returns the SHA-256 hash of a certificate's SubjectPublicKeyInfo
+func spkiHash(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// verifyPins checks that a pin matches a certificate of the verified chains,
+// or the leaf certificate when chain verification is skipped
+func verifyPins(cs tls.ConnectionState, pins [][]byte) error {
+	var certs []*x509.Certificate
+	for _, chain := range cs.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+	if len(cs.VerifiedChains) == 0 && len(cs.PeerCertificates) > 0 {
+		certs = cs.PeerCertificates[:1]
+	}
+
+	for _, cert := range certs {
+		hash := spkiHash(cert)
+		for _, pin := range pins {
+			if string(hash) == string(pin) {
+				return nil
+			}
+		}
+	}
+	return errPinMismatch
+}
+
+// listenerTLSConfig builds the TLS server configuration for the local
+// listener. With a client CA bundle, clients must present a certificate
+// that chains to it.
+func listenerTLSConfig(opts *config.ListenTLS) (*tls.Config, error) {
+	certFile, err := config.ResolvePath(opts.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	keyFile, err := config.ResolvePath(opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load listener certificate: %w", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if opts.ClientCAFile != "" {
+		pool, err := loadCertPool(opts.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// tlsHandshake completes the handshake with a TLS client and logs the
+// subject of its certificate, if it sent one
+func tlsHandshake(conn *tls.Conn) error {
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		log.Printf("TLS client %s authenticated as %s", conn.RemoteAddr(), certs[0].Subject)
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go-socks5-chain/config"
+)
+
+// testCA issues certificates for TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue creates a leaf certificate for a server (with DNS names and IPs) or
+// a client (with just a common name)
+func (ca *testCA) issue(t *testing.T, commonName string, dnsNames []string, ips []net.IP, client bool) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	usage := x509.ExtKeyUsageServerAuth
+	if client {
+		usage = x509.ExtKeyUsageClientAuth
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeKeyPair writes cert and its key as PEM files in dir
+func writeKeyPair(t *testing.T, dir, name string, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func pinOf(cert *x509.Certificate) string {
+	return "sha256/" + base64.StdEncoding.EncodeToString(spkiHash(cert))
+}
+
+func TestTLSUpstream(t *testing.T) {
+	configDir := t.TempDir()
+	originalGetConfigPath := config.GetConfigPath()
+	config.SetConfigPathForTesting(func() (string, error) { return configDir, nil })
+	defer config.SetConfigPathForTesting(originalGetConfigPath)
+
+	ca := newTestCA(t)
+	os.WriteFile(filepath.Join(configDir, "upstream_ca.pem"), ca.pem, 0600)
+	serverCert := ca.issue(t, "socks.example.test", []string{"socks.example.test"}, nil, false)
+
+	clientCA := newTestCA(t)
+	clientCert := clientCA.issue(t, "proxy-client", nil, nil, true)
+	writeKeyPair(t, configDir, "client", clientCert)
+	clientPool := x509.NewCertPool()
+	clientPool.AddCert(clientCA.cert)
+
+	otherCA := newTestCA(t)
+
+	echo := startEchoServer(t)
+
+	startTLSRelay := func(t *testing.T, requireClientCert bool) *relayUpstream {
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		serverConfig := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+		if requireClientCert {
+			serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			serverConfig.ClientCAs = clientPool
+		}
+		return serveRelayUpstream(t, tls.NewListener(inner, serverConfig), "user", "pass")
+	}
+
+	tests := []struct {
+		name              string
+		opts              *config.TLSOptions
+		requireClientCert bool
+		wantErr           bool
+		wantPinErr        bool
+	}{
+		{
+			name: "CA bundle with SNI override",
+			opts: &config.TLSOptions{ServerName: "socks.example.test", CAFile: "upstream_ca.pem"},
+		},
+		{
+			name:    "CA bundle without SNI override",
+			opts:    &config.TLSOptions{CAFile: "upstream_ca.pem"},
+			wantErr: true,
+		},
+		{
+			name:    "System roots",
+			opts:    &config.TLSOptions{ServerName: "socks.example.test"},
+			wantErr: true,
+		},
+		{
+			name: "Leaf pin without CA",
+			opts: &config.TLSOptions{Pins: []string{pinOf(serverCert.Leaf)}},
+		},
+		{
+			name:       "Wrong pin without CA",
+			opts:       &config.TLSOptions{Pins: []string{pinOf(otherCA.cert)}},
+			wantErr:    true,
+			wantPinErr: true,
+		},
+		{
+			name: "CA pin with CA bundle",
+			opts: &config.TLSOptions{
+				ServerName: "socks.example.test",
+				CAFile:     "upstream_ca.pem",
+				Pins:       []string{pinOf(otherCA.cert), pinOf(ca.cert)},
+			},
+		},
+		{
+			name: "Client certificate",
+			opts: &config.TLSOptions{
+				ServerName: "socks.example.test",
+				CAFile:     "upstream_ca.pem",
+				CertFile:   "client.crt",
+				KeyFile:    filepath.Join(configDir, "client.key"),
+			},
+			requireClientCert: true,
+		},
+		{
+			name:              "Missing client certificate",
+			opts:              &config.TLSOptions{ServerName: "socks.example.test", CAFile: "upstream_ca.pem"},
+			requireClientCert: true,
+			wantErr:           true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := startTLSRelay(t, tt.requireClientCert)
+			hop := relay.hop()
+			server := NewServer(&config.Config{
+				Username:           hop.Username,
+				Password:           hop.Password,
+				UpstreamHost:       hop.Host,
+				UpstreamPort:       hop.Port,
+				UpstreamTLS:        true,
+				UpstreamTLSOptions: tt.opts,
+			})
+
+			conn, _, err := server.dialTarget("", nil, echo.Addr().String(), false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dialTarget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantPinErr && !errors.Is(err, errPinMismatch) {
+				t.Errorf("dialTarget() error = %v, want a pin mismatch", err)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			echoThrough(t, conn, "socks over tls")
+		})
+	}
+}
+
+func TestTLSUpstreamSilentAfterHandshake(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping dial timeout test in short mode")
+	}
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "socks.example.test", nil, nil, false)
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer inner.Close()
+	listener := tls.NewListener(inner, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+
+	// Complete the TLS handshake, then never answer the SOCKS5 greeting
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	server := NewServer(&config.Config{
+		Username:           "user",
+		Password:           "pass",
+		UpstreamHost:       "127.0.0.1",
+		UpstreamPort:       inner.Addr().(*net.TCPAddr).Port,
+		UpstreamTLS:        true,
+		UpstreamTLSOptions: &config.TLSOptions{Pins: []string{pinOf(serverCert.Leaf)}},
+	})
+
+	probeErr := make(chan error, 1)
+	go func() { probeErr <- server.probeEndpoint(server.config.UpstreamEndpoints()[0]) }()
+	dialErr := make(chan error, 1)
+	go func() {
+		conn, _, err := server.dialTarget("", nil, "192.0.2.1:80", false)
+		if conn != nil {
+			conn.Close()
+		}
+		dialErr <- err
+	}()
+
+	timeout := time.After(dialTimeout + 5*time.Second)
+	for name, errs := range map[string]chan error{"probeEndpoint()": probeErr, "dialTarget()": dialErr} {
+		select {
+		case err := <-errs:
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				t.Errorf("%s error = %v, want a timeout", name, err)
+			}
+		case <-timeout:
+			t.Fatalf("%s is still waiting for the SOCKS5 greeting", name)
+		}
+	}
+}
+
+func TestParsePins(t *testing.T) {
+	hash := make([]byte, 32)
+	valid := base64.StdEncoding.EncodeToString(hash)
+
+	if _, err := parsePins([]string{valid, "sha256/" + valid}); err != nil {
+		t.Errorf("parsePins() error = %v", err)
+	}
+	for _, pin := range []string{"not base64!", base64.StdEncoding.EncodeToString(hash[:20])} {
+		if _, err := parsePins([]string{pin}); err == nil {
+			t.Errorf("parsePins(%q) accepted an invalid pin", pin)
+		}
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	configDir := t.TempDir()
+	originalGetConfigPath := config.GetConfigPath()
+	config.SetConfigPathForTesting(func() (string, error) { return configDir, nil })
+	defer config.SetConfigPathForTesting(originalGetConfigPath)
+
+	ca := newTestCA(t)
+	os.WriteFile(filepath.Join(configDir, "client_ca.pem"), ca.pem, 0600)
+	writeKeyPair(t, configDir, "listener", ca.issue(t, "proxy", nil, []net.IP{net.ParseIP("127.0.0.1")}, false))
+	clientCert := ca.issue(t, "alice", nil, nil, true)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		name         string
+		clientCA     string
+		clientCerts  []tls.Certificate
+		plain        bool
+		wantGreeting bool
+	}{
+		{name: "TLS without client certificates", wantGreeting: true},
+		{name: "Mutual TLS", clientCA: "client_ca.pem", clientCerts: []tls.Certificate{clientCert}, wantGreeting: true},
+		{name: "Mutual TLS without a client certificate", clientCA: "client_ca.pem"},
+		{name: "Plain SOCKS5 client", plain: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer(&config.Config{
+				UpstreamHost: "127.0.0.1",
+				UpstreamPort: 9999,
+				ListenTLS: &config.ListenTLS{
+					CertFile:     "listener.crt",
+					KeyFile:      "listener.key",
+					ClientCAFile: tt.clientCA,
+				},
+			})
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to create listener: %v", err)
+			}
+			localAddr := listener.Addr().String()
+			listener.Close()
+
+			go server.Start(localAddr)
+			defer server.Stop()
+			time.Sleep(100 * time.Millisecond)
+
+			var conn net.Conn
+			if tt.plain {
+				conn, err = net.Dial("tcp", localAddr)
+			} else {
+				conn, err = tls.Dial("tcp", localAddr, &tls.Config{RootCAs: roots, Certificates: tt.clientCerts})
+			}
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+			conn.Write([]byte{0x05, 0x01, 0x00})
+			response := make([]byte, 2)
+			_, err = io.ReadFull(conn, response)
+			gotGreeting := err == nil && response[0] == 0x05 && response[1] == 0x00
+			if gotGreeting != tt.wantGreeting {
+				t.Errorf("Got SOCKS5 greeting = %v (response %v, error %v), want %v", gotGreeting, response, err, tt.wantGreeting)
+			}
+		})
+	}
+}
+
+func TestTLSListenerBadCertificate(t *testing.T) {
+	server := NewServer(&config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 9999,
+		ListenTLS:    &config.ListenTLS{CertFile: "/nonexistent/cert.pem", KeyFile: "/nonexistent/key.pem"},
+	})
+	if err := server.Start("127.0.0.1:0"); err == nil {
+		t.Error("Start() succeeded without a usable certificate")
+	}
+}
@@ -0,0 +1,350 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-socks5-chain/config"
+)
+
+// tproxyUDPIdleTimeout ends UDP flows that have seen no datagrams for a while
+const tproxyUDPIdleTimeout = 2 * time.Minute
+
+// startTProxy accepts TCP connections and UDP datagrams that the firewall
+// diverts to addr with TPROXY. They keep their original destination as the
+// local address, and are sent to it through the chain.
+func (s *Server) startTProxy(addr string) error {
+	if !transparentSupported {
+		return fmt.Errorf("TPROXY is only supported on Linux")
+	}
+	listener, err := listenTransparentTCP(addr)
+	if err != nil {
+		return fmt.Errorf("failed to start TPROXY listener: %v", err)
+	}
+	conn, err := listenTransparentUDP(addr)
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to start TPROXY UDP listener: %v", err)
+	}
+	s.tproxy = listener
+	s.tproxyUDP = newTProxyUDP(s, conn)
+
+	go s.serveTProxyTCP(listener)
+	go s.tproxyUDP.serve()
+	return nil
+}
+
+func (s *Server) serveTProxyTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Failed to accept TPROXY connection: %v", err)
+			continue
+		}
+
+		// The local address is where the client meant to connect
+		target := conn.LocalAddr().String()
+		if isListenerAddr(listener.Addr().String(), target) {
+			log.Printf("Dropping connection from %s to the TPROXY listener itself", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		s.wg.Add(1)
+		go s.handleForward(conn, target)
+	}
+}
+
+// isListenerAddr reports whether target, the original destination of a
+// diverted connection or datagram, is the TPROXY listener at listen itself.
+// A listener on the unspecified address is reached on every local address.
+func isListenerAddr(listen, target string) bool {
+	listenHost, listenPort, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || port != listenPort {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if listenIP := net.ParseIP(listenHost); listenIP != nil && !listenIP.IsUnspecified() {
+		return ip.Equal(listenIP)
+	}
+	return isLocalIP(ip)
+}
+
+// isLocalIP reports whether ip is a loopback address or belongs to a local
+// interface
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// tproxyFlowKey identifies a UDP flow by its client and original destination
+type tproxyFlowKey struct {
+	client string
+	dst    string
+}
+
+// tproxyUDP maps UDP flows diverted by TPROXY onto UDP ASSOCIATE sessions
+// with the last upstream hop, one per flow
+type tproxyUDP struct {
+	server *Server
+	conn   *net.UDPConn
+
+	mu     sync.Mutex
+	flows  map[tproxyFlowKey]*tproxyFlow
+	closed bool
+}
+
+func newTProxyUDP(s *Server, conn *net.UDPConn) *tproxyUDP {
+	return &tproxyUDP{server: s, conn: conn, flows: make(map[tproxyFlowKey]*tproxyFlow)}
+}
+
+func (t *tproxyUDP) serve() {
+	buf := make([]byte, maxUDPPacket)
+	oob := make([]byte, 128)
+	for {
+		n, oobn, _, from, err := t.conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		dst, err := origDstFromOOB(oob[:oobn])
+		if err != nil {
+			log.Printf("No original destination for UDP datagram from %s: %v", from, err)
+			continue
+		}
+		if isListenerAddr(t.conn.LocalAddr().String(), dst) {
+			continue
+		}
+		t.relay(from, dst, append([]byte(nil), buf[:n]...))
+	}
+}
+
+// relay sends a datagram from client to dst, setting up its flow first if
+// there is none yet. Setting up a flow takes a round trip through the
+// chain, so it is done without holding up other flows. Routing rules apply
+// to each new flow: direct ones skip the chain, rejected ones are dropped,
+// as are those for named chains, which don't relay UDP, and the rest use
+// the upstream as UDP ASSOCIATE does.
+func (t *tproxyUDP) relay(client *net.UDPAddr, dst string, payload []byte) {
+	key := tproxyFlowKey{client: client.String(), dst: dst}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	flow := t.flows[key]
+	if flow == nil {
+		rule := t.server.route("", client, dst)
+		switch rule.Action {
+		case config.RouteReject:
+			t.mu.Unlock()
+			return
+		case config.RouteChain:
+			t.mu.Unlock()
+			log.Printf("Dropping UDP datagram from %s to %s: chain %s doesn't relay UDP", client, dst, rule.Chain)
+			return
+		}
+		flow = &tproxyFlow{key: key, direct: rule.Action == config.RouteDirect, ready: make(chan struct{})}
+		t.flows[key] = flow
+		go t.open(flow, client)
+	}
+	t.mu.Unlock()
+
+	// Datagrams that arrive while the flow is set up wait for it
+	select {
+	case <-flow.ready:
+		flow.send(payload)
+	default:
+		go flow.send(payload)
+	}
+}
+
+// open sets up the UDP ASSOCIATE session of flow and relays the replies
+func (t *tproxyUDP) open(flow *tproxyFlow, client *net.UDPAddr) {
+	err := flow.open(t.server, client)
+	close(flow.ready)
+	if err != nil {
+		log.Printf("Failed to set up UDP flow from %s to %s: %v", flow.key.client, flow.key.dst, err)
+		t.remove(flow)
+		return
+	}
+
+	// The flow ends when the upstream drops the association or it idles
+	if flow.control != nil {
+		go func() {
+			io.Copy(io.Discard, flow.control)
+			flow.close()
+		}()
+	}
+	flow.relayReplies()
+	flow.close()
+	t.remove(flow)
+}
+
+func (t *tproxyUDP) remove(flow *tproxyFlow) {
+	t.mu.Lock()
+	if t.flows[flow.key] == flow {
+		delete(t.flows, flow.key)
+	}
+	t.mu.Unlock()
+}
+
+// close stops the listener and ends every flow
+func (t *tproxyUDP) close() {
+	t.conn.Close()
+	t.mu.Lock()
+	t.closed = true
+	flows := t.flows
+	t.flows = make(map[tproxyFlowKey]*tproxyFlow)
+	t.mu.Unlock()
+
+	for _, flow := range flows {
+		go func() {
+			<-flow.ready
+			flow.close()
+		}()
+	}
+}
+
+// tproxyFlow relays one client's datagrams to one destination through a
+// UDP ASSOCIATE session, or directly, and sends the replies back from that
+// destination
+type tproxyFlow struct {
+	key    tproxyFlowKey
+	direct bool          // Datagrams go straight to the destination
+	ready  chan struct{} // Closed once open has returned
+	err    error
+
+	control      net.Conn     // Upstream control connection, nil if direct
+	upstreamSide *net.UDPConn // Exchanges datagrams with the upstream relay
+	relayAddr    *net.UDPAddr // The upstream relay, or the destination if direct
+	reply        *net.UDPConn // Bound to the destination, connected to the client
+	header       []byte       // SOCKS5 UDP request header for the destination
+
+	lastActive atomic.Int64
+	closeOnce  sync.Once
+}
+
+func (f *tproxyFlow) open(s *Server, client *net.UDPAddr) error {
+	f.touch()
+	if f.direct {
+		// Datagrams are sent as they are, without a SOCKS5 header
+		f.relayAddr, f.err = net.ResolveUDPAddr("udp", f.key.dst)
+	} else {
+		f.err = f.associate(s, client)
+	}
+	if f.err == nil {
+		if f.upstreamSide, f.err = net.ListenUDP("udp", nil); f.err == nil {
+			f.reply, f.err = dialTransparentUDP(f.key.dst, client)
+		}
+	}
+	if f.err != nil {
+		f.close()
+	}
+	return f.err
+}
+
+// associate sets up the UDP ASSOCIATE session with the last upstream hop
+func (f *tproxyFlow) associate(s *Server, client *net.UDPAddr) error {
+	header, err := encodeAddr(f.key.dst)
+	if err != nil {
+		return err
+	}
+	f.header = append([]byte{0x00, 0x00, 0x00}, header...)
+
+	if f.control, err = s.connectToUpstream(client); err != nil {
+		return err
+	}
+	f.relayAddr, err = s.upstreamUDPAssociate(f.control)
+	return err
+}
+
+// send encapsulates payload and sends it to the upstream relay once the
+// flow is set up
+func (f *tproxyFlow) send(payload []byte) {
+	<-f.ready
+	if f.err != nil {
+		return
+	}
+	f.touch()
+	f.upstreamSide.WriteToUDP(append(append([]byte(nil), f.header...), payload...), f.relayAddr)
+}
+
+// relayReplies sends datagrams from the upstream relay, or the destination
+// of a direct flow, to the client until the flow is closed or has been idle
+// for tproxyUDPIdleTimeout
+func (f *tproxyFlow) relayReplies() {
+	buf := make([]byte, maxUDPPacket)
+	for {
+		f.upstreamSide.SetReadDeadline(time.Now().Add(tproxyUDPIdleTimeout))
+		n, from, err := f.upstreamSide.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() &&
+				time.Since(time.Unix(0, f.lastActive.Load())) < tproxyUDPIdleTimeout {
+				continue
+			}
+			return
+		}
+		if !from.IP.Equal(f.relayAddr.IP) || from.Port != f.relayAddr.Port {
+			continue
+		}
+		payload := buf[:n]
+		if !f.direct {
+			frag, _, headerLen, err := parseUDPHeader(payload)
+			if err != nil || frag != 0 {
+				continue
+			}
+			payload = payload[headerLen:]
+		}
+		f.touch()
+		f.reply.Write(payload)
+	}
+}
+
+func (f *tproxyFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+func (f *tproxyFlow) close() {
+	f.closeOnce.Do(func() {
+		if f.control != nil {
+			f.control.Close()
+		}
+		if f.upstreamSide != nil {
+			f.upstreamSide.Close()
+		}
+		if f.reply != nil {
+			f.reply.Close()
+		}
+	})
+}
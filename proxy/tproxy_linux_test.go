@@ -0,0 +1,162 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go-socks5-chain/config"
+)
+
+// skipWithoutTransparent skips tests that need CAP_NET_ADMIN for
+// IP_TRANSPARENT
+func skipWithoutTransparent(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Skipf("IP_TRANSPARENT sockets are not available: %v", err)
+	}
+}
+
+func TestTProxyDropsDirectConnections(t *testing.T) {
+	upstream := startRelayUpstream(t, "user", "pass")
+	server := relayServer(upstream)
+	skipWithoutTransparent(t, server.startTProxy("127.0.0.1:0"))
+	defer server.closeServices()
+
+	conn, err := net.Dial("tcp", server.tproxy.Addr().String())
+	if err != nil {
+		t.Fatalf("Dialing TPROXY listener: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() error = %v, want the connection closed", err)
+	}
+	if got := upstream.requestedTargets(); len(got) != 0 {
+		t.Errorf("Upstream targets = %v, want none", got)
+	}
+}
+
+func TestTProxyUDPFlow(t *testing.T) {
+	upstream := startUDPUpstream(t)
+	server := NewServer(&config.Config{
+		Username:     "testuser",
+		Password:     "testpass",
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.listener.Addr().(*net.TCPAddr).Port,
+	})
+	conn, err := listenTransparentUDP("127.0.0.1:0")
+	skipWithoutTransparent(t, err)
+	tp := newTProxyUDP(server, conn)
+	defer tp.close()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// A destination nothing listens on, which replies must appear to come from
+	free, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := free.LocalAddr().String()
+	free.Close()
+
+	for _, msg := range []string{"first", "second"} {
+		tp.relay(client.LocalAddr().(*net.UDPAddr), dst, []byte(msg))
+
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, maxUDPPacket)
+		n, from, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("Reading reply: %v", err)
+		}
+		if string(buf[:n]) != msg || from.String() != dst {
+			t.Errorf("Reply = %q from %s, want %q from %s", buf[:n], from, msg, dst)
+		}
+	}
+
+	tp.mu.Lock()
+	flows := len(tp.flows)
+	tp.mu.Unlock()
+	if flows != 1 {
+		t.Errorf("%d flows, want both datagrams on one", flows)
+	}
+}
+
+func TestTProxyUDPRules(t *testing.T) {
+	upstream := startUDPUpstream(t)
+	server := NewServer(&config.Config{
+		Username:     "testuser",
+		Password:     "testpass",
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.listener.Addr().(*net.TCPAddr).Port,
+		Rules: []config.Rule{
+			{Ports: []string{"25"}, Action: config.RouteReject},
+			{Ports: []string{"9"}, Action: config.RouteChain, Chain: "other"},
+			{Networks: []string{"127.0.0.3/32"}, Action: config.RouteDirect},
+		},
+	})
+	conn, err := listenTransparentUDP("127.0.0.1:0")
+	skipWithoutTransparent(t, err)
+	tp := newTProxyUDP(server, conn)
+	defer tp.close()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+
+	tp.relay(clientAddr, "127.0.0.2:25", []byte("rejected"))
+	tp.relay(clientAddr, "127.0.0.2:9", []byte("chained"))
+	tp.mu.Lock()
+	flows := len(tp.flows)
+	tp.mu.Unlock()
+	if flows != 0 {
+		t.Errorf("%d flows after rejected and chained datagrams, want none", flows)
+	}
+
+	// The direct destination shares its address with the socket the flow
+	// answers from, which SO_REUSEADDR allows
+	echo, err := listenTransparentUDP("127.0.0.3:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, maxUDPPacket)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+	dst := echo.LocalAddr().String()
+
+	tp.relay(clientAddr, dst, []byte("direct"))
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, maxUDPPacket)
+	n, from, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("Reading reply: %v", err)
+	}
+	if string(buf[:n]) != "direct" || from.String() != dst {
+		t.Errorf("Reply = %q from %s, want %q from %s", buf[:n], from, "direct", dst)
+	}
+	tp.mu.Lock()
+	flow := tp.flows[tproxyFlowKey{client: clientAddr.String(), dst: dst}]
+	tp.mu.Unlock()
+	if flow == nil || flow.control != nil {
+		t.Error("Direct flow went through the upstream")
+	}
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsListenerAddr(t *testing.T) {
+	tests := []struct {
+		listen string
+		target string
+		want   bool
+	}{
+		{"127.0.0.1:12346", "127.0.0.1:12346", true},
+		{"127.0.0.1:12346", "127.0.0.2:12346", false},
+		{"0.0.0.0:12346", "127.0.0.1:12346", true},
+		{"0.0.0.0:12346", "[::1]:12346", true},
+		{"[::]:12346", "127.0.0.1:12346", true},
+		{"0.0.0.0:12346", "127.0.0.1:80", false},
+		{"0.0.0.0:12346", "192.0.2.1:12346", false},
+		{"0.0.0.0:12346", "example.com:12346", false},
+	}
+	for _, tt := range tests {
+		if got := isListenerAddr(tt.listen, tt.target); got != tt.want {
+			t.Errorf("isListenerAddr(%q, %q) = %v, want %v", tt.listen, tt.target, got, tt.want)
+		}
+	}
+
+	// The host's own addresses reach a wildcard listener too
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			target := net.JoinHostPort(ipNet.IP.String(), "12346")
+			if !isListenerAddr("0.0.0.0:12346", target) {
+				t.Errorf("isListenerAddr(0.0.0.0:12346, %q) = false, want true", target)
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+)
+
+// startTransparent accepts connections redirected to addr by the firewall,
+// such as with iptables REDIRECT, and sends each through the chain to the
+// destination it originally had
+func (s *Server) startTransparent(addr string) error {
+	if !transparentSupported {
+		return fmt.Errorf("transparent proxying is only supported on Linux")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start transparent listener: %v", err)
+	}
+	s.transparent = listener
+	go s.serveTransparent(listener)
+	return nil
+}
+
+func (s *Server) serveTransparent(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Failed to accept transparent connection: %v", err)
+			continue
+		}
+
+		target, err := originalDst(conn)
+		if err == nil && target == conn.LocalAddr().String() {
+			// Connecting to the listener itself would loop back to it
+			err = fmt.Errorf("connection was not redirected")
+		}
+		if err != nil {
+			log.Printf("No original destination for transparent connection from %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+
+		s.wg.Add(1)
+		go s.handleForward(conn, target)
+	}
+}
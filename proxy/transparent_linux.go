@@ -0,0 +1,164 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const transparentSupported = true
+
+// SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv4.h and
+// linux/netfilter_ipv6/ip6_tables.h
+const (
+	soOriginalDst     = 80
+	ip6tSoOriginalDst = 80
+)
+
+// originalDst returns the destination conn had before the firewall
+// redirected it, as recorded by connection tracking
+func originalDst(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", fmt.Errorf("not a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	ipv6 := local != nil && local.IP.To4() == nil
+	var target string
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			// IPv6MTUInfo starts with a sockaddr_in6
+			info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			target = joinSockaddr(net.IP(info.Addr.Addr[:]), port[:])
+			return
+		}
+
+		// IPv6Mreq is large enough for a sockaddr_in: family, port, address
+		mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		target = joinSockaddr(net.IP(mreq.Multiaddr[4:8]), mreq.Multiaddr[2:4])
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("SO_ORIGINAL_DST: %v", err)
+	}
+	return target, nil
+}
+
+// joinSockaddr formats an address and a port in network byte order
+func joinSockaddr(ip net.IP, port []byte) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port[0])<<8|int(port[1])))
+}
+
+// listenTransparentTCP listens on addr with IP_TRANSPARENT, so it accepts
+// connections TPROXY diverts to it whatever their destination
+func listenTransparentTCP(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: transparentControl(false)}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// listenTransparentUDP is listenTransparentTCP for UDP. The original
+// destination of every datagram is passed along as a control message.
+func listenTransparentUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: transparentControl(true)}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// dialTransparentUDP opens a UDP socket bound to local, which need not be
+// an address of this machine, and connected to remote. It is used to answer
+// a client from the address it sent its datagrams to.
+func dialTransparentUDP(local string, remote *net.UDPAddr) (*net.UDPConn, error) {
+	localAddr, err := net.ResolveUDPAddr("udp", local)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{LocalAddr: localAddr, Control: transparentControl(false)}
+	conn, err := d.Dial("udp", remote.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// transparentControl sets IP_TRANSPARENT, and with recvOrigDst asks for the
+// original destination of datagrams. SO_REUSEADDR lets several flows answer
+// from the same destination address.
+func transparentControl(recvOrigDst bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			set := func(level, opt int) {
+				if sockErr == nil {
+					sockErr = unix.SetsockoptInt(int(fd), level, opt, 1)
+				}
+			}
+			set(unix.SOL_SOCKET, unix.SO_REUSEADDR)
+			if strings.HasSuffix(network, "6") {
+				set(unix.SOL_IPV6, unix.IPV6_TRANSPARENT)
+				if recvOrigDst {
+					set(unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR)
+					// IPv4 datagrams arrive on dual-stack sockets too
+					set(unix.SOL_IP, unix.IP_RECVORIGDSTADDR)
+				}
+				return
+			}
+			set(unix.SOL_IP, unix.IP_TRANSPARENT)
+			if recvOrigDst {
+				set(unix.SOL_IP, unix.IP_RECVORIGDSTADDR)
+			}
+		})
+		if err == nil {
+			err = sockErr
+		}
+		return err
+	}
+}
+
+// origDstFromOOB returns the original destination of a datagram from the
+// control messages it was received with
+func origDstFromOOB(oob []byte) (string, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return "", err
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_ORIGDSTADDR && len(msg.Data) >= 8:
+			// sockaddr_in: family, port, address
+			return joinSockaddr(net.IP(msg.Data[4:8]), msg.Data[2:4]), nil
+		case msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR && len(msg.Data) >= 24:
+			// sockaddr_in6: family, port, flow info, address
+			return joinSockaddr(net.IP(msg.Data[8:24]), msg.Data[2:4]), nil
+		}
+	}
+	return "", fmt.Errorf("no original destination in control messages")
+}
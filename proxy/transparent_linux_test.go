@@ -0,0 +1,238 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestTransparentRejectsUnredirected(t *testing.T) {
+	upstream := startRelayUpstream(t, "user", "pass")
+	server := relayServer(upstream)
+	if err := server.startTransparent("127.0.0.1:0"); err != nil {
+		t.Fatalf("startTransparent() error = %v", err)
+	}
+	defer server.transparent.Close()
+
+	// Without a REDIRECT there is either no original destination or it is
+	// the listener itself, and either way the connection is dropped
+	conn, err := net.Dial("tcp", server.transparent.Addr().String())
+	if err != nil {
+		t.Fatalf("Dialing transparent listener: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() error = %v, want the connection closed", err)
+	}
+	if got := upstream.requestedTargets(); len(got) != 0 {
+		t.Errorf("Upstream targets = %v, want none", got)
+	}
+}
+
+func TestJoinSockaddr(t *testing.T) {
+	tests := []struct {
+		ip   net.IP
+		port []byte
+		want string
+	}{
+		{net.IPv4(192, 0, 2, 1).To4(), []byte{0x01, 0xbb}, "192.0.2.1:443"},
+		{net.ParseIP("2001:db8::1"), []byte{0x1f, 0x90}, "[2001:db8::1]:8080"},
+	}
+	for _, tt := range tests {
+		if got := joinSockaddr(tt.ip, tt.port); got != tt.want {
+			t.Errorf("joinSockaddr(%v, %v) = %s, want %s", tt.ip, tt.port, got, tt.want)
+		}
+	}
+}
+
+// enterNetNamespace moves the test's goroutine into a new network namespace
+// with only the loopback interface. The thread stays locked, so it exits
+// with the test instead of going back to the scheduler. Sockets must be
+// opened from this goroutine to be in the namespace.
+func enterNetNamespace(t *testing.T) {
+	t.Helper()
+	runtime.LockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("Network namespaces are not available: %v", err)
+	}
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("socket() error = %v", err)
+	}
+	defer unix.Close(fd)
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		t.Fatalf("NewIfreq() error = %v", err)
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		t.Fatalf("SIOCGIFFLAGS error = %v", err)
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr); err != nil {
+		t.Fatalf("SIOCSIFFLAGS error = %v", err)
+	}
+}
+
+// nlAttr encodes a netlink attribute
+func nlAttr(typ uint16, data []byte) []byte {
+	b := binary.NativeEndian.AppendUint16(nil, uint16(4+len(data)))
+	b = binary.NativeEndian.AppendUint16(b, typ)
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func nlNested(typ uint16, attrs ...[]byte) []byte {
+	return nlAttr(typ|unix.NLA_F_NESTED, bytes.Join(attrs, nil))
+}
+
+func nlString(typ uint16, s string) []byte {
+	return nlAttr(typ, append([]byte(s), 0))
+}
+
+// nlUint32 encodes a netfilter attribute, which are in network byte order
+func nlUint32(typ uint16, v uint32) []byte {
+	return nlAttr(typ, binary.BigEndian.AppendUint32(nil, v))
+}
+
+// nfMessage encodes an nfnetlink message
+func nfMessage(typ, flags uint16, seq uint32, family uint8, resID uint16, attrs ...[]byte) []byte {
+	body := append([]byte{family, 0}, binary.BigEndian.AppendUint16(nil, resID)...)
+	body = append(body, bytes.Join(attrs, nil)...)
+	b := binary.NativeEndian.AppendUint32(nil, uint32(unix.NLMSG_HDRLEN+len(body)))
+	b = binary.NativeEndian.AppendUint16(b, typ)
+	b = binary.NativeEndian.AppendUint16(b, flags)
+	b = binary.NativeEndian.AppendUint32(b, seq)
+	b = binary.NativeEndian.AppendUint32(b, 0)
+	return append(b, body...)
+}
+
+// redirectLocalTCP installs the nftables equivalent of
+// "iptables -t nat -A OUTPUT -p tcp --dport from -j REDIRECT --to-ports to"
+// in the current network namespace
+func redirectLocalTCP(t *testing.T, from, to int) {
+	t.Helper()
+	port := func(p int) []byte { return binary.BigEndian.AppendUint16(nil, uint16(p)) }
+	expr := func(name string, attrs ...[]byte) []byte {
+		return nlNested(unix.NFTA_LIST_ELEM, nlString(unix.NFTA_EXPR_NAME, name), nlNested(unix.NFTA_EXPR_DATA, attrs...))
+	}
+	equals := func(value []byte) []byte {
+		return expr("cmp",
+			nlUint32(unix.NFTA_CMP_SREG, unix.NFT_REG_1),
+			nlUint32(unix.NFTA_CMP_OP, unix.NFT_CMP_EQ),
+			nlNested(unix.NFTA_CMP_DATA, nlAttr(unix.NFTA_DATA_VALUE, value)))
+	}
+	nft := func(msg uint16) uint16 { return unix.NFNL_SUBSYS_NFTABLES<<8 | msg }
+	const create = unix.NLM_F_REQUEST | unix.NLM_F_CREATE | unix.NLM_F_ACK
+
+	batch := bytes.Join([][]byte{
+		nfMessage(unix.NFNL_MSG_BATCH_BEGIN, unix.NLM_F_REQUEST, 1, unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES),
+		nfMessage(nft(unix.NFT_MSG_NEWTABLE), create, 2, unix.NFPROTO_INET, 0,
+			nlString(unix.NFTA_TABLE_NAME, "test")),
+		nfMessage(nft(unix.NFT_MSG_NEWCHAIN), create, 3, unix.NFPROTO_INET, 0,
+			nlString(unix.NFTA_CHAIN_TABLE, "test"),
+			nlString(unix.NFTA_CHAIN_NAME, "output"),
+			nlNested(unix.NFTA_CHAIN_HOOK,
+				nlUint32(unix.NFTA_HOOK_HOOKNUM, unix.NF_INET_LOCAL_OUT),
+				nlUint32(unix.NFTA_HOOK_PRIORITY, uint32(0xffffffff-100+1))), // NF_IP_PRI_NAT_DST, -100
+			nlString(unix.NFTA_CHAIN_TYPE, "nat")),
+		nfMessage(nft(unix.NFT_MSG_NEWRULE), create, 4, unix.NFPROTO_INET, 0,
+			nlString(unix.NFTA_RULE_TABLE, "test"),
+			nlString(unix.NFTA_RULE_CHAIN, "output"),
+			nlNested(unix.NFTA_RULE_EXPRESSIONS,
+				expr("meta", nlUint32(unix.NFTA_META_KEY, unix.NFT_META_L4PROTO), nlUint32(unix.NFTA_META_DREG, unix.NFT_REG_1)),
+				equals([]byte{unix.IPPROTO_TCP}),
+				expr("payload",
+					nlUint32(unix.NFTA_PAYLOAD_DREG, unix.NFT_REG_1),
+					nlUint32(unix.NFTA_PAYLOAD_BASE, unix.NFT_PAYLOAD_TRANSPORT_HEADER),
+					nlUint32(unix.NFTA_PAYLOAD_OFFSET, 2),
+					nlUint32(unix.NFTA_PAYLOAD_LEN, 2)),
+				equals(port(from)),
+				expr("immediate",
+					nlUint32(unix.NFTA_IMMEDIATE_DREG, unix.NFT_REG_1),
+					nlNested(unix.NFTA_IMMEDIATE_DATA, nlAttr(unix.NFTA_DATA_VALUE, port(to)))),
+				expr("redir", nlUint32(unix.NFTA_REDIR_REG_PROTO_MIN, unix.NFT_REG_1)))),
+		nfMessage(unix.NFNL_MSG_BATCH_END, unix.NLM_F_REQUEST, 5, unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES),
+	}, nil)
+
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		t.Fatalf("netlink socket() error = %v", err)
+	}
+	defer unix.Close(fd)
+	unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 2})
+	if err := unix.Sendto(fd, batch, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		t.Fatalf("Sending nftables batch: %v", err)
+	}
+
+	// Every message asked for an acknowledgement
+	buf := make([]byte, 8192)
+	for acked := 0; acked < 3; {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			t.Fatalf("Reading nftables acknowledgements: %v", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			t.Fatalf("ParseNetlinkMessage() error = %v", err)
+		}
+		for _, msg := range msgs {
+			if msg.Header.Type != unix.NLMSG_ERROR || len(msg.Data) < 4 {
+				continue
+			}
+			if errno := int32(binary.NativeEndian.Uint32(msg.Data)); errno != 0 {
+				if syscall.Errno(-errno) == syscall.EPERM {
+					t.Skipf("Installing nftables rules needs CAP_NET_ADMIN")
+				}
+				t.Fatalf("nftables message %d failed: %v", msg.Header.Seq, syscall.Errno(-errno))
+			}
+			acked++
+		}
+	}
+}
+
+func TestOriginalDstRedirected(t *testing.T) {
+	enterNetNamespace(t)
+
+	// Subtests would run on other threads, outside the namespace
+	for i, loopback := range []string{"127.0.0.1", "::1"} {
+		listener, err := net.Listen("tcp", net.JoinHostPort(loopback, "0"))
+		if err != nil {
+			t.Fatalf("Listen() on %s error = %v", loopback, err)
+		}
+		defer listener.Close()
+		from := 8001 + i
+		redirectLocalTCP(t, from, listener.Addr().(*net.TCPAddr).Port)
+
+		dest := net.JoinHostPort(loopback, strconv.Itoa(from))
+		client, err := net.DialTimeout("tcp", dest, 2*time.Second)
+		if err != nil {
+			t.Fatalf("Dialing %s error = %v, want it redirected to %s", dest, err, listener.Addr())
+		}
+		defer client.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("Accept() error = %v", err)
+		}
+		defer conn.Close()
+
+		if got, err := originalDst(conn); err != nil || got != dest {
+			t.Errorf("originalDst() = %q, %v, want %s", got, err, dest)
+		}
+	}
+}
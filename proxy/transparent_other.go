@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+const transparentSupported = false
+
+func originalDst(net.Conn) (string, error) {
+	return "", errors.New("transparent proxying is only supported on Linux")
+}
+
+func listenTransparentTCP(string) (net.Listener, error) {
+	return nil, errors.New("TPROXY is only supported on Linux")
+}
+
+func listenTransparentUDP(string) (*net.UDPConn, error) {
+	return nil, errors.New("TPROXY is only supported on Linux")
+}
+
+func dialTransparentUDP(string, *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errors.New("TPROXY is only supported on Linux")
+}
+
+func origDstFromOOB([]byte) (string, error) {
+	return "", errors.New("TPROXY is only supported on Linux")
+}
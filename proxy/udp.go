@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"go-socks5-chain/config"
+)
+
+// maxUDPPacket is the largest datagram we relay
+const maxUDPPacket = 65535
+
+// handleUDPAssociate serves a UDP ASSOCIATE request. It sets up a matching
+// association with the last upstream hop and relays encapsulated datagrams
+// between the client and the upstream relay until either TCP control
+// connection closes. The routing rules apply to each datagram's
+// destination: direct ones are sent from here, and rejected ones are
+// dropped, as are those for named chains, which don't relay UDP. Clients on
+// a Unix domain socket have no IP address to bind the relay to and check
+// datagrams against, so they can't associate.
+func (s *Server) handleUDPAssociate(client net.Conn, target string, l *listener) {
+	localAddr, ok := client.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		log.Printf("UDP ASSOCIATE from %s on non-TCP listener %s is not supported", client.RemoteAddr(), l.id)
+		s.sendReply(client, repCommandNotSupported, "")
+		return
+	}
+
+	upstreamConn, err := s.connectToUpstream(client.RemoteAddr())
+	if err != nil {
+		log.Printf("Failed to connect to upstream: %v", err)
+		s.sendReply(client, replyCode(err), "")
+		return
+	}
+	defer upstreamConn.Close()
+
+	relay, err := s.upstreamUDPAssociate(upstreamConn)
+	if err != nil {
+		log.Printf("Upstream UDP associate failed: %v", err)
+		s.sendReply(client, replyCode(err), "")
+		return
+	}
+
+	// Open the client-facing socket on the address the client reached us on
+	clientSide, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP})
+	if err != nil {
+		log.Printf("Failed to open UDP relay: %v", err)
+		s.sendReply(client, repGeneralFailure, "")
+		return
+	}
+	defer clientSide.Close()
+
+	upstreamSide, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Printf("Failed to open upstream UDP socket: %v", err)
+		s.sendReply(client, repGeneralFailure, "")
+		return
+	}
+	defer upstreamSide.Close()
+
+	if err := s.sendReply(client, repSuccess, clientSide.LocalAddr().String()); err != nil {
+		return
+	}
+
+	assoc := &udpAssociation{
+		clientSide:   clientSide,
+		upstreamSide: upstreamSide,
+		relay:        relay,
+		route: func(dst string) config.Rule {
+			return s.route(l.id, client.RemoteAddr(), dst)
+		},
+		direct:      make(map[string]*net.UDPAddr),
+		directPeers: make(map[string]bool),
+	}
+	if tcpAddr, ok := client.RemoteAddr().(*net.TCPAddr); ok {
+		assoc.clientIP = tcpAddr.IP
+	}
+	// The client may announce the address it will send from
+	if _, port, err := net.SplitHostPort(target); err == nil {
+		assoc.clientPort, _ = strconv.Atoi(port)
+	}
+
+	log.Printf("UDP association for %s via upstream relay %s", client.RemoteAddr(), relay)
+
+	// The association lives as long as both TCP control connections do
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() { once.Do(func() { close(done) }) }
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		io.Copy(io.Discard, client)
+		stop()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(io.Discard, upstreamConn)
+		stop()
+	}()
+	go func() {
+		defer wg.Done()
+		assoc.relayFromClient()
+		stop()
+	}()
+	go func() {
+		defer wg.Done()
+		assoc.relayFromUpstream()
+		stop()
+	}()
+
+	select {
+	case <-done:
+	case <-s.ctx.Done():
+	}
+
+	client.Close()
+	upstreamConn.Close()
+	clientSide.Close()
+	upstreamSide.Close()
+	wg.Wait()
+}
+
+// upstreamUDPAssociate sends a UDP ASSOCIATE request over an authenticated
+// upstream connection and returns the address of the upstream's UDP relay
+func (s *Server) upstreamUDPAssociate(conn net.Conn) (*net.UDPAddr, error) {
+	// We don't know which address our datagrams will come from, so send zeros
+	addr, _ := encodeAddr(unspecifiedAddr)
+	if _, err := conn.Write(append([]byte{VERSION, cmdUDPAssociate, 0x00}, addr...)); err != nil {
+		return nil, err
+	}
+
+	rep, bound, err := readReply(conn)
+	if err != nil {
+		return nil, err
+	}
+	if rep != repSuccess {
+		return nil, &replyError{rep: rep}
+	}
+
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		return nil, err
+	}
+	// An unspecified address means "the host you are talking to". Without
+	// further hops that is whichever endpoint conn reached.
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		host := s.lastHop().Host
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && len(s.config.Chain) == 0 {
+			host = tcpAddr.IP.String()
+		}
+		relay, err = net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(relay.Port)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return relay, nil
+}
+
+// udpAssociation relays datagrams for a single UDP ASSOCIATE session
+type udpAssociation struct {
+	clientSide   *net.UDPConn // Receives datagrams from the local client
+	upstreamSide *net.UDPConn // Exchanges datagrams with the upstream relay
+	relay        *net.UDPAddr
+
+	clientIP   net.IP // Only datagrams from this IP are accepted
+	clientPort int    // Expected client port, 0 if not announced
+
+	// route returns the routing rule for a destination
+	route func(dst string) config.Rule
+
+	mu          sync.Mutex
+	clientAddr  *net.UDPAddr            // Learned from the first accepted datagram
+	direct      map[string]*net.UDPAddr // Resolved direct destinations
+	directPeers map[string]bool         // Addresses direct replies may come from
+}
+
+func (a *udpAssociation) relayFromClient() {
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, from, err := a.clientSide.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if a.clientIP != nil && !from.IP.Equal(a.clientIP) {
+			continue
+		}
+		if a.clientPort != 0 && from.Port != a.clientPort {
+			continue
+		}
+		frag, dst, headerLen, err := parseUDPHeader(buf[:n])
+		if err != nil {
+			log.Printf("Dropping malformed UDP datagram from %s: %v", from, err)
+			continue
+		}
+		if frag != 0 {
+			// Fragmentation is optional and we don't implement reassembly
+			continue
+		}
+		rule := a.route(dst)
+		switch rule.Action {
+		case config.RouteReject:
+			log.Printf("Dropping UDP datagram from %s to %s rejected by routing rule", from, dst)
+			continue
+		case config.RouteChain:
+			log.Printf("Dropping UDP datagram from %s to %s: chain %s doesn't relay UDP", from, dst, rule.Chain)
+			continue
+		}
+
+		a.mu.Lock()
+		a.clientAddr = from
+		a.mu.Unlock()
+
+		if rule.Action == config.RouteDirect {
+			a.sendDirect(dst, buf[headerLen:n])
+			continue
+		}
+		a.upstreamSide.WriteToUDP(buf[:n], a.relay)
+	}
+}
+
+// sendDirect sends payload from the upstream socket straight to dst, and
+// lets replies from there through to the client
+func (a *udpAssociation) sendDirect(dst string, payload []byte) {
+	a.mu.Lock()
+	addr := a.direct[dst]
+	a.mu.Unlock()
+	if addr == nil {
+		var err error
+		if addr, err = net.ResolveUDPAddr("udp", dst); err != nil {
+			log.Printf("Dropping UDP datagram to %s: %v", dst, err)
+			return
+		}
+		a.mu.Lock()
+		a.direct[dst] = addr
+		a.directPeers[addr.String()] = true
+		a.mu.Unlock()
+	}
+	a.upstreamSide.WriteToUDP(payload, addr)
+}
+
+func (a *udpAssociation) relayFromUpstream() {
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, from, err := a.upstreamSide.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		a.mu.Lock()
+		clientAddr := a.clientAddr
+		directPeer := a.directPeers[from.String()]
+		a.mu.Unlock()
+		if clientAddr == nil {
+			continue
+		}
+
+		packet := buf[:n]
+		if from.IP.Equal(a.relay.IP) && from.Port == a.relay.Port {
+			frag, _, _, err := parseUDPHeader(packet)
+			if err != nil || frag != 0 {
+				continue
+			}
+		} else if directPeer {
+			// Direct replies arrive bare and get the header the upstream
+			// relay would have added
+			header, err := encodeAddr(from.String())
+			if err != nil {
+				continue
+			}
+			packet = append(append([]byte{0x00, 0x00, 0x00}, header...), packet...)
+		} else {
+			continue
+		}
+
+		a.clientSide.WriteToUDP(packet, clientAddr)
+	}
+}
+
+// parseUDPHeader parses the SOCKS5 UDP request header and returns the
+// fragment number, the destination address and the header length
+func parseUDPHeader(packet []byte) (byte, string, int, error) {
+	if len(packet) < 4 {
+		return 0, "", 0, fmt.Errorf("datagram too short")
+	}
+	r := bytes.NewReader(packet[3:])
+	addr, err := readAddr(r)
+	if err != nil {
+		return 0, "", 0, err
+	}
+	return packet[2], addr, len(packet) - r.Len(), nil
+}
@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go-socks5-chain/config"
+)
+
+// udpUpstream is a mock SOCKS5 upstream that accepts UDP ASSOCIATE and
+// echoes every datagram back unchanged, as if the target had answered
+type udpUpstream struct {
+	listener net.Listener
+	closed   chan struct{} // Signalled when a control connection ends
+}
+
+func startUDPUpstream(t *testing.T) *udpUpstream {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start UDP upstream: %v", err)
+	}
+	u := &udpUpstream{listener: listener, closed: make(chan struct{}, 1)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go u.handle(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return u
+}
+
+func (u *udpUpstream) handle(conn net.Conn) {
+	defer conn.Close()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	io.ReadFull(conn, methods)
+	conn.Write([]byte{0x05, 0x02})
+
+	auth := make([]byte, 2)
+	io.ReadFull(conn, auth)
+	user := make([]byte, auth[1])
+	io.ReadFull(conn, user)
+	plen := make([]byte, 1)
+	io.ReadFull(conn, plen)
+	pass := make([]byte, plen[0])
+	io.ReadFull(conn, pass)
+	conn.Write([]byte{0x01, 0x00})
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	if _, err := readAddr(conn); err != nil {
+		return
+	}
+	if req[1] != 0x03 {
+		conn.Write([]byte{0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+	defer relay.Close()
+	bound, _ := encodeAddr(relay.LocalAddr().String())
+	conn.Write(append([]byte{0x05, 0x00, 0x00}, bound...))
+
+	go func() {
+		buf := make([]byte, maxUDPPacket)
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			relay.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	io.Copy(io.Discard, conn)
+	u.closed <- struct{}{}
+}
+
+func TestUDPAssociateIntegration(t *testing.T) {
+	upstream := startUDPUpstream(t)
+
+	cfg := &config.Config{
+		Username:     "testuser",
+		Password:     "testpass",
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.listener.Addr().(*net.TCPAddr).Port,
+		// Rules match each datagram's destination, not the client's address
+		Rules: []config.Rule{
+			{Networks: []string{"127.0.0.2/32"}, Action: config.RouteDirect},
+			{Networks: []string{"127.0.0.0/8"}, Action: config.RouteReject},
+			{Ports: []string{"25"}, Action: config.RouteReject},
+			{Ports: []string{"9"}, Action: config.RouteChain, Chain: "other"},
+		},
+	}
+	server := NewServer(cfg)
+
+	// A destination for direct datagrams, which answers differently from
+	// the upstream so its replies can't be mistaken for echoes
+	direct, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Fatalf("Failed to start direct destination: %v", err)
+	}
+	defer direct.Close()
+	go func() {
+		buf := make([]byte, maxUDPPacket)
+		for {
+			n, from, err := direct.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			direct.WriteToUDP(append([]byte("pong "), buf[:n]...), from)
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+	localAddr := listener.Addr().String()
+	listener.Close()
+
+	go server.Start(localAddr)
+	time.Sleep(100 * time.Millisecond)
+	defer server.Stop()
+
+	control, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer control.Close()
+
+	control.Write([]byte{0x05, 0x01, 0x00})
+	response := make([]byte, 2)
+	if _, err := io.ReadFull(control, response); err != nil {
+		t.Fatalf("Failed to read handshake response: %v", err)
+	}
+
+	control.Write([]byte{0x05, 0x03, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(control, reply); err != nil {
+		t.Fatalf("Failed to read UDP ASSOCIATE reply: %v", err)
+	}
+	if reply[1] != 0x00 {
+		t.Fatalf("UDP ASSOCIATE failed with status: %d", reply[1])
+	}
+	relayAddr, err := readAddr(control)
+	if err != nil {
+		t.Fatalf("Failed to read relay address: %v", err)
+	}
+
+	udpConn, err := net.Dial("udp", relayAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial relay: %v", err)
+	}
+	defer udpConn.Close()
+
+	target, _ := encodeAddr("198.51.100.7:53")
+	datagram := append(append([]byte{0x00, 0x00, 0x00}, target...), "ping"...)
+	fragment := append(append([]byte{0x00, 0x00, 0x01}, target...), "fragment"...)
+	smtp, _ := encodeAddr("198.51.100.7:25")
+	rejected := append(append([]byte{0x00, 0x00, 0x00}, smtp...), "rejected"...)
+	discard, _ := encodeAddr("198.51.100.7:9")
+	chained := append(append([]byte{0x00, 0x00, 0x00}, discard...), "chained"...)
+
+	// The fragment and the rejected and chained datagrams must be dropped,
+	// so the first echo is the plain datagram
+	udpConn.Write(fragment)
+	udpConn.Write(rejected)
+	udpConn.Write(chained)
+	udpConn.Write(datagram)
+
+	udpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, maxUDPPacket)
+	n, err := udpConn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read echoed datagram: %v", err)
+	}
+	if !bytes.Equal(buf[:n], datagram) {
+		t.Errorf("Echoed datagram = %v, want %v", buf[:n], datagram)
+	}
+
+	// Direct datagrams skip the upstream, and their replies come back with
+	// the destination in the header
+	directAddr, _ := encodeAddr(direct.LocalAddr().String())
+	udpConn.Write(append(append([]byte{0x00, 0x00, 0x00}, directAddr...), "ping"...))
+	n, err = udpConn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read direct reply: %v", err)
+	}
+	want := append(append([]byte{0x00, 0x00, 0x00}, directAddr...), "pong ping"...)
+	if !bytes.Equal(buf[:n], want) {
+		t.Errorf("Direct reply = %q, want %q", buf[:n], want)
+	}
+
+	// Closing the control connection must tear down the upstream association
+	control.Close()
+	select {
+	case <-upstream.closed:
+	case <-time.After(2 * time.Second):
+		t.Error("Upstream control connection was not closed with the client's")
+	}
+}
+
+func TestParseUDPHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		packet     []byte
+		wantFrag   byte
+		wantAddr   string
+		wantHeader int
+		wantError  bool
+	}{
+		{
+			name:       "IPv4 destination",
+			packet:     []byte{0, 0, 0, 0x01, 10, 0, 0, 1, 0x00, 0x35, 'x'},
+			wantAddr:   "10.0.0.1:53",
+			wantHeader: 10,
+		},
+		{
+			name:       "Domain destination with fragment",
+			packet:     []byte{0, 0, 2, 0x03, 3, 'f', 'o', 'o', 0x01, 0xbb},
+			wantFrag:   2,
+			wantAddr:   "foo:443",
+			wantHeader: 10,
+		},
+		{
+			name:      "Too short",
+			packet:    []byte{0, 0, 0},
+			wantError: true,
+		},
+		{
+			name:      "Truncated address",
+			packet:    []byte{0, 0, 0, 0x04, 0x20, 0x01},
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frag, addr, headerLen, err := parseUDPHeader(tt.packet)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("parseUDPHeader() error = %v, wantError %v", err, tt.wantError)
+			}
+			if tt.wantError {
+				return
+			}
+			if frag != tt.wantFrag || addr != tt.wantAddr || headerLen != tt.wantHeader {
+				t.Errorf("parseUDPHeader() = (%d, %q, %d), want (%d, %q, %d)",
+					frag, addr, headerLen, tt.wantFrag, tt.wantAddr, tt.wantHeader)
+			}
+		})
+	}
+}